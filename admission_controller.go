@@ -1,26 +1,55 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/admission/v1beta1"
-	corev1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// verificationConcurrency specifies how many images of a request are verified in parallel
+const verificationConcurrency = 8
+
+// unverifiedImagesAnnotation lists images of objects admitted by the mutating webhook without verification,
+// because verification timed out or the signature store was unavailable, so they can be checked later
+const unverifiedImagesAnnotation = "stampy.io/unverified-images"
+
+// verificationAnnotation is set to verificationFailed on objects admitted with images
+// that failed verification, in audit and warn modes
+const (
+	verificationAnnotation = "stampy.io/verification"
+	verificationFailed     = "failed"
+)
+
+// admissionMetrics are published on /debug/vars as admission.<name>
+var admissionMetrics = expvar.NewMap("admission")
+
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
 	Value interface{} `json:"value,omitempty"`
 }
 
+// admissionResponse extends the vendored admission response with warnings, which the API server
+// returns to the client, for example kubectl
+type admissionResponse struct {
+	*v1beta1.AdmissionResponse
+
+	Warnings []string `json:"warnings,omitempty"`
+}
+
 // AdmissionControllerInterface exposes admission controller related operations
 type AdmissionControllerInterface interface {
-	Mutate(ar *v1beta1.AdmissionReview) (r *v1beta1.AdmissionResponse)
+	Mutate(ctx context.Context, ar *v1beta1.AdmissionReview) (r *admissionResponse)
+	Validate(ctx context.Context, ar *v1beta1.AdmissionReview) (r *admissionResponse)
 }
 
 // AdmissionController implements admission controller related operations for AWS
@@ -28,133 +57,618 @@ type admissionController struct {
 	logger *logrus.Logger
 	region string // aws region that stores signatures
 	bucket string // aws s3 bucket that stores signatures
+	policy *Policy
+
+	imageManager   ImageControllerInterface
+	signatureStore SignatureStore
+	trustStore     validator.TrustStore // trust anchors for signing certificates
+	keyring        validator.Keyring    // public keys of OpenPGP signatures, optional
+
+	cache    CacheConfig
+	verdicts *lruCache // signature verdicts by repository and manifest digest
+}
+
+// verdict is a cached result of the manifest signature verification
+type verdict struct {
+	err       error
+	signature *validator.SignatureResponse // signature response of verified manifests
+	trust     trustGeneration              // trust anchors the verdict was reached with
 }
 
-// NewAdmissionController constructor
-func NewAdmissionController(region, bucket string, logger *logrus.Logger) (AdmissionControllerInterface, error) {
+// trustGeneration identifies the contents of the trust store and the keyring, which change
+// when they are reloaded with other trust anchors
+type trustGeneration struct {
+	trustStore uint64
+	keyring    uint64
+}
+
+// NewAdmissionController constructor. Signatures are read from the S3 bucket in the region,
+// unless a signature store is provided.
+func NewAdmissionController(region, bucket string, policy *Policy, trustStore validator.TrustStore, keyring validator.Keyring, signatureStore SignatureStore, cache CacheConfig, registries RegistryConfig, logger *logrus.Logger) (AdmissionControllerInterface, error) {
+	imageManager, err := newRegistryRouter(NewImageController(region, logger), registries, logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if signatureStore == nil {
+		if signatureStore, err = newS3SignatureStore(region, bucket, nil, logger); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	ac := new(admissionController)
 	ac.region = region
 	ac.bucket = bucket
+	ac.policy = policy
 	ac.logger = logger
+	ac.imageManager = newCachingImageController(imageManager, cache)
+	ac.signatureStore = newCachingSignatureStore(signatureStore, cache)
+	ac.trustStore = trustStore
+	ac.keyring = keyring
+	ac.cache = cache
+	ac.verdicts = newLRUCache("verdicts", cache.Size)
 	return ac, nil
 }
 
 // Mutate implements mutating webhook
-func (ac *admissionController) Mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	var deployment corev1.Deployment
-	if err := json.Unmarshal(ar.Request.Object.Raw, &deployment); err != nil {
-		ac.logger.Errorf("api=mutate, reason='could not unmarshal raw object: %v'", err)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: fmt.Sprintf("could not decode admission request object"),
+func (ac *admissionController) Mutate(ctx context.Context, ar *v1beta1.AdmissionReview) *admissionResponse {
+	patch, annotations, warnings, denied := ac.verify(ctx, "mutate", ar)
+	if denied != nil {
+		return &admissionResponse{AdmissionResponse: denied}
+	}
+
+	// updates of subresources cannot change the annotations of the object
+	if len(annotations) > 0 && ar.Request.SubResource == "" {
+		annotationOps, err := annotationsPatch(ar.Request.Object.Raw, annotations)
+		if err != nil {
+			ac.logger.Errorf("api=mutate, reason=annotationsPatch, kind=%q, err=%v", ar.Request.Kind.Kind, err)
+		}
+		patch = append(patch, annotationOps...)
+	}
+
+	if len(patch) == 0 {
+		return &admissionResponse{
+			AdmissionResponse: &v1beta1.AdmissionResponse{
+				Allowed: true,
 			},
+			Warnings: warnings,
 		}
 	}
 
-	imageManager := NewImageController(ac.region, ac.bucket, ac.logger)
-	var patch []patchOperation
-	containers := deployment.Spec.Template.Spec.Containers
-	for i, container := range containers {
-		image := container.Image
-		host, repo, tag := parseImage(image)
-		manifest, err := imageManager.GetManifest(repo, tag)
-		if err != nil {
-			ac.logger.Errorf("api=mutate, reason=GetManifest, repo=%q, tag=%q, err=%v", repo, tag, err)
-			return &v1beta1.AdmissionResponse{
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionResponse{
+			AdmissionResponse: &v1beta1.AdmissionResponse{
 				Result: &metav1.Status{
-					Message: fmt.Sprintf("failed to fetch manifest, repo=%q, tag=%q", repo, tag),
+					Message: err.Error(),
 				},
+			},
+		}
+	}
+
+	ac.logger.Infof("api=mutate, admissionResponse_patch=%v\n", string(patchBytes))
+	return &admissionResponse{
+		AdmissionResponse: &v1beta1.AdmissionResponse{
+			Allowed: true,
+			Patch:   patchBytes,
+			PatchType: func() *v1beta1.PatchType {
+				pt := v1beta1.PatchTypeJSONPatch
+				return &pt
+			}(),
+		},
+		Warnings: warnings,
+	}
+}
+
+// Validate implements validating webhook. It runs the same signature checks as Mutate
+// but does not pin images to their manifest digests. Validating webhooks cannot patch
+// objects, so the annotations are returned as audit annotations of the request.
+func (ac *admissionController) Validate(ctx context.Context, ar *v1beta1.AdmissionReview) *admissionResponse {
+	_, annotations, warnings, denied := ac.verify(ctx, "validate", ar)
+	if denied != nil {
+		return &admissionResponse{AdmissionResponse: denied}
+	}
+
+	ac.logger.Infof("api=validate, kind=%q, allowed=true", ar.Request.Kind.Kind)
+	return &admissionResponse{
+		AdmissionResponse: &v1beta1.AdmissionResponse{
+			Allowed:          true,
+			AuditAnnotations: auditAnnotations(annotations),
+		},
+		Warnings: warnings,
+	}
+}
+
+// auditAnnotations returns the annotations without their prefix, as the API server prefixes
+// audit annotations with the name of the webhook
+func auditAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	audit := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		audit[key[strings.Index(key, "/")+1:]] = value
+	}
+	return audit
+}
+
+// verify verifies images of the admitted object in parallel. It returns the patch pinning
+// verified images to their manifest digests, annotations recording failed and unverified images,
+// and warnings for the client, or a response denying the request. Images not verified before
+// the context deadline are admitted or denied according to the timeout policy.
+func (ac *admissionController) verify(ctx context.Context, api string, ar *v1beta1.AdmissionReview) ([]patchOperation, map[string]string, []string, *v1beta1.AdmissionResponse) {
+	kind := ar.Request.Kind.Kind
+	podSpec, podSpecPath, err := extractPodSpec(kind, ar.Request.Object.Raw)
+	if errors.Cause(err) == errUnsupportedKind {
+		ac.logger.Warnf("api=%s, reason=extractPodSpec, kind=%q, policy=%q", api, kind, ac.policy.UnknownKinds)
+		if ac.policy.UnknownKinds == policyAllow {
+			return nil, nil, nil, nil
+		}
+		annotations, warnings, denied := ac.unverifiable(api, ar, causeUnsupportedKind, fmt.Sprintf("unsupported kind %q", kind))
+		return nil, annotations, warnings, denied
+	}
+	if err != nil {
+		ac.logger.Errorf("api=%s, reason='could not extract pod spec: %v', kind=%q", api, err, kind)
+		annotations, warnings, denied := ac.unverifiable(api, ar, causeUndecodableObject, "could not decode admission request object")
+		return nil, annotations, warnings, denied
+	}
+
+	var images []*containerImage
+	for _, list := range podSpec.subresourceContainerLists(ar.Request.SubResource) {
+		listPolicy := ac.policy.containerListPolicy(list.name)
+		for i, container := range list.containers {
+			if listPolicy.allowsImage(container.Image) {
+				ac.logger.Infof("api=%s, reason='image allowed by policy', containerList=%q, container=%q, image=%q", api, list.name, container.Name, container.Image)
+				continue
 			}
+			images = append(images, &containerImage{
+				container: container.Name,
+				image:     container.Image,
+				path:      fmt.Sprintf("%s/%s/%d/image", podSpecPath, list.name, i),
+			})
 		}
-		ac.logger.Infof("manifest %q", manifest)
+	}
 
-		manifestDigest := validator.SHA256Digest([]byte(manifest))
-		manifestSig, err := imageManager.GetManifestSignature(repo, manifestDigest)
-		if err != nil {
-			ac.logger.Errorf("api=mutate, reason=GetManifestSignature, repo=%q, tag=%q, err=%v", repo, tag, err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: fmt.Sprintf("failed to fetch manifest signature, repo=%q, tag=%q", repo, tag),
-				},
+	ac.verifyImages(ctx, ar.Request.Namespace, images)
+
+	var patch []patchOperation
+	var causes []metav1.StatusCause
+	var unverified []string
+	for _, image := range images {
+		if image.err != nil {
+			if ac.allowsUnverified(image.err, ar.Request.Namespace, image.image) {
+				unverified = append(unverified, image.image)
+				continue
 			}
+			causes = append(causes, verificationCause(image.err, image.container, image.image, image.path))
+			continue
 		}
 
-		if len(manifestSig) == 0 {
-			ac.logger.Errorf("api=mutate, reason='empty manifest signature', repo=%q, tag=%q, manifest_digest=%q, err=%v", repo, tag, manifestDigest, err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: fmt.Sprintf("failed to fetch manifest signature, repo=%q, tag=%q", repo, tag),
+		patch = append(patch, patchOperation{
+			Op:    "replace",
+			Path:  image.path,
+			Value: image.pinned,
+		})
+	}
+
+	mode := ac.policy.mode(ar.Request.Namespace)
+	if len(causes) > 0 && mode == modeEnforce {
+		messages := make([]string, len(causes))
+		for i, cause := range causes {
+			messages[i] = cause.Message
+		}
+		ac.logger.Errorf("api=%s, reason='image verification failed', kind=%q, name=%q, namespace=%q, failures=%d", api, kind, ar.Request.Name, ar.Request.Namespace, len(causes))
+		return nil, nil, nil, &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("%d container image(s) failed verification: %s", len(causes), strings.Join(messages, "; ")),
+				Details: &metav1.StatusDetails{
+					Name:   ar.Request.Name,
+					Kind:   kind,
+					Causes: causes,
 				},
+			},
+		}
+	}
+
+	annotations, warnings := ac.admitFailures(api, mode, ar, causes)
+
+	if len(unverified) > 0 {
+		ac.logger.Warnf("api=%s, reason='verification incomplete, allowed by policy', kind=%q, name=%q, namespace=%q, images=%q", api, kind, ar.Request.Name, ar.Request.Namespace, unverified)
+		admissionMetrics.Add("allowed_unverified", 1)
+		admissionMetrics.Add("unverified_images", int64(len(unverified)))
+		annotations[unverifiedImagesAnnotation] = strings.Join(unverified, ",")
+		if mode == modeWarn {
+			for _, image := range unverified {
+				warnings = append(warnings, fmt.Sprintf("image %q was not verified", image))
 			}
 		}
+	}
+	return patch, annotations, warnings, nil
+}
 
-		status, manifestDigest, err := validator.ValidateManifestSignature(manifest, manifestSig)
-		if err != nil {
-			ac.logger.Errorf("api=mutate, reason=ValidateManifestSignature, repo=%q, tag=%q, err=%v", repo, tag, err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: fmt.Sprintf("failed to validate manifest signature, repo=%q, tag=%q", repo, tag),
-				},
+// unverifiable returns the response denying the request, whose images cannot be verified, with
+// the message. In audit and warn modes the request is admitted as failed, and the annotations
+// and warnings of the failure are returned instead.
+func (ac *admissionController) unverifiable(api string, ar *v1beta1.AdmissionReview, cause metav1.CauseType, message string) (map[string]string, []string, *v1beta1.AdmissionResponse) {
+	mode := ac.policy.mode(ar.Request.Namespace)
+	if mode == modeEnforce {
+		return nil, nil, &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: message,
+			},
+		}
+	}
+
+	annotations, warnings := ac.admitFailures(api, mode, ar, []metav1.StatusCause{{Type: cause, Message: message}})
+	return annotations, warnings, nil
+}
+
+// admitFailures returns annotations and warnings of the request admitted with the failures
+// by the mode, and audits the failures
+func (ac *admissionController) admitFailures(api, mode string, ar *v1beta1.AdmissionReview, causes []metav1.StatusCause) (map[string]string, []string) {
+	var warnings []string
+	annotations := map[string]string{}
+	if len(causes) == 0 {
+		return annotations, warnings
+	}
+
+	ac.auditFailures(api, mode, ar, causes)
+	admissionMetrics.Add("allowed_failed_"+mode, 1)
+	annotations[verificationAnnotation] = verificationFailed
+	if mode == modeWarn {
+		for _, cause := range causes {
+			warnings = append(warnings, "image verification failed: "+cause.Message)
+		}
+	}
+	return annotations, warnings
+}
+
+// auditFailures logs an event for each verification failure of the request allowed by the mode
+func (ac *admissionController) auditFailures(api, mode string, ar *v1beta1.AdmissionReview, causes []metav1.StatusCause) {
+	for _, cause := range causes {
+		ac.logger.
+			WithField(eventField, "VerificationFailed").
+			WithField(modeField, mode).
+			WithField(kindField, ar.Request.Kind.Kind).
+			WithField(namespaceField, ar.Request.Namespace).
+			WithField(nameField, ar.Request.Name).
+			WithField(fieldField, cause.Field).
+			WithField(causeField, string(cause.Type)).
+			WithField(reasonField, cause.Message).
+			Warnf("api=%s, reason='image verification failed, allowed by %s mode'", api, mode)
+	}
+}
+
+// allowsUnverified returns true if the policy allows the image of the namespace that could not be
+// verified with the error, because verification timed out or the signature store is unavailable
+func (ac *admissionController) allowsUnverified(err error, namespace, image string) bool {
+	verr, ok := err.(*verificationError)
+	if !ok {
+		return false
+	}
+
+	switch verr.cause {
+	case causeTimeout:
+		return ac.policy.failurePolicy(namespace, image).Timeout == policyAllow
+	case causeStoreUnavailable:
+		return ac.policy.failurePolicy(namespace, image).Unavailable == policyAllow
+	default:
+		return false
+	}
+}
+
+// containerImage is an image of a container with its verification result
+type containerImage struct {
+	container string
+	image     string
+	path      string // JSON patch path of the image
+
+	pinned string // image reference pinned to the manifest digest
+	err    error
+}
+
+// verifyImages verifies images of the namespace in parallel until the context is done. Images not
+// verified by then fail with the timeout cause.
+func (ac *admissionController) verifyImages(ctx context.Context, namespace string, images []*containerImage) {
+	type result struct {
+		index  int
+		pinned string
+		err    error
+	}
+
+	results := make(chan result, len(images))
+	sem := make(chan struct{}, verificationConcurrency)
+	go func() {
+		for i, image := range images {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
 			}
+			go func(i int, image string) {
+				defer func() { <-sem }()
+				pinned, err := ac.verifyImage(ctx, namespace, image)
+				results <- result{index: i, pinned: pinned, err: err}
+			}(i, image.image)
 		}
+	}()
 
-		if !status {
-			ac.logger.Errorf("api=mutate, reason=ValidateManifestSignature, status=%t, repo=%q, tag=%q, err=%v", status, repo, tag, err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: fmt.Sprintf("failed to validate manifest signature, repo=%q, tag=%q", repo, tag),
-				},
+	done := make([]bool, len(images))
+	for received := 0; received < len(images); received++ {
+		select {
+		case r := <-results:
+			done[r.index] = true
+			images[r.index].pinned, images[r.index].err = r.pinned, r.err
+		case <-ctx.Done():
+			for i, image := range images {
+				if !done[i] {
+					image.err = newVerificationError(causeTimeout, "verification did not complete before the deadline")
+				}
 			}
+			return
 		}
+	}
+}
 
-		patch = append(patch, patchOperation{
-			Op:    "replace",
-			Path:  fmt.Sprintf("/spec/template/spec/containers/%d/image", i),
-			Value: fmt.Sprintf("%s/%s@sha256:%s", host, repo, manifestDigest),
-		})
+// verifyImage validates the signature of the image manifest and returns the image reference
+// pinned to the manifest digest. Returned errors are *verificationError.
+func (ac *admissionController) verifyImage(ctx context.Context, namespace, image string) (string, error) {
+	ref := parseImage(image)
+	manifest, err := ac.imageManager.GetManifest(ctx, ref)
+	if ctx.Err() != nil {
+		return "", newVerificationError(causeTimeout, "verification did not complete before the deadline")
+	}
+	if errors.Cause(err) == errReportedDigestMismatch {
+		ac.logger.Errorf("api=verifyImage, reason=GetManifest, image=%q, err=%v", ref, err)
+		return "", newVerificationError(causeManifestRewritten, "manifest does not match the digest reported by the registry")
 	}
-	patchBytes, err := json.Marshal(patch)
 	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+		ac.logger.Errorf("api=verifyImage, reason=GetManifest, image=%q, err=%v", ref, err)
+		return "", newVerificationError(causeManifestNotFound, "failed to fetch manifest")
+	}
+	ac.logger.Infof("manifest %q", manifest)
+
+	// the manifest is identified by the referenced digest, whatever its algorithm, or else by its
+	// sha256 digest. Signatures are matched separately with the hash algorithm of each artifact.
+	manifestDigest := validator.SHA256Digest([]byte(manifest))
+	if ref.Digest != "" {
+		digest, ok := validator.MatchDigest(ref.Digest, []byte(manifest))
+		if !ok {
+			ac.logger.Errorf("api=verifyImage, reason='manifest digest mismatch', image=%q, manifest_digest=%q", ref, digest)
+			return "", newVerificationError(causeDigestMismatch, "tag resolves to %s, not the referenced digest", digest)
 		}
+		manifestDigest = digest
 	}
 
-	ac.logger.Infof("api=mutate, admissionResponse_patch=%v\n", string(patchBytes))
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
+	if err = ac.verifyManifest(ctx, namespace, ref, manifest, manifestDigest); err != nil {
+		return "", err
+	}
+
+	if ac.policy.MultiArch == multiArchPlatforms {
+		if err = ac.verifyPlatforms(ctx, namespace, ref, manifest); err != nil {
+			return "", err
+		}
 	}
+
+	// images with an index are pinned to the index digest, so nodes pull their own platform
+	return ref.pinned(manifestDigest), nil
 }
 
-func parseImage(image string) (host, repo, tag string) {
-	s := strings.SplitN(image, "/", 2)
-	host = s[0]
+// verifyPlatforms verifies signatures of every platform manifest of the index.
+// Manifests that are not indexes have no platform manifests.
+func (ac *admissionController) verifyPlatforms(ctx context.Context, namespace string, ref *imageReference, manifest string) error {
+	header, err := parseManifest(manifest)
+	if err != nil {
+		ac.logger.Errorf("api=verifyPlatforms, image=%q, err=%v", ref, err)
+		return newVerificationError(causeBadSignature, "failed to parse manifest")
+	}
+	if !header.isIndex() {
+		return nil
+	}
+
+	for _, descriptor := range header.Manifests {
+		platformRef := &imageReference{Host: ref.Host, Repo: ref.Repo, Digest: descriptor.Digest}
+		platformManifest, err := ac.imageManager.GetManifest(ctx, platformRef)
+		if ctx.Err() != nil {
+			return newVerificationError(causeTimeout, "verification did not complete before the deadline")
+		}
+		if errors.Cause(err) == errReportedDigestMismatch {
+			ac.logger.Errorf("api=verifyPlatforms, reason=GetManifest, image=%q, platform=%q, err=%v", platformRef, descriptor.Platform, err)
+			return newVerificationError(causeManifestRewritten, "manifest of platform %s does not match the digest reported by the registry", descriptor.Platform)
+		}
+		if err != nil {
+			ac.logger.Errorf("api=verifyPlatforms, reason=GetManifest, image=%q, platform=%q, err=%v", platformRef, descriptor.Platform, err)
+			return newVerificationError(causeManifestNotFound, "failed to fetch manifest of platform %s", descriptor.Platform)
+		}
+
+		platformDigest, ok := validator.MatchDigest(descriptor.Digest, []byte(platformManifest))
+		if !ok {
+			ac.logger.Errorf("api=verifyPlatforms, reason='manifest digest mismatch', image=%q, platform=%q, manifest_digest=%q", platformRef, descriptor.Platform, platformDigest)
+			return newVerificationError(causeDigestMismatch, "manifest of platform %s has digest %s", descriptor.Platform, platformDigest)
+		}
 
-	imagePath := ""
-	if len(s) > 1 {
-		imagePath = s[1]
+		if err = ac.verifyManifest(ctx, namespace, platformRef, platformManifest, platformDigest); err != nil {
+			verr := err.(*verificationError)
+			return newVerificationError(verr.cause, "platform %s: %s", descriptor.Platform, verr.message)
+		}
 	}
+	return nil
+}
 
-	s = strings.SplitN(imagePath, "@", 2)
-	repo = s[0]
-	if len(s) > 1 {
-		tag = s[1]
-		return host, repo, tag
+// verifyManifest validates the signature of the manifest, caching the verdict by the manifest digest,
+// and checks the commit of the signature for the namespace. Returned errors are *verificationError.
+func (ac *admissionController) verifyManifest(ctx context.Context, namespace string, ref *imageReference, manifest, manifestDigest string) error {
+	key := ref.pinned(manifestDigest)
+	trust := ac.trustGeneration()
+	cached, ok := ac.verdicts.get(key)
+	// verdicts reached with trust anchors that have since been reloaded are stale
+	if !ok || cached.(*verdict).trust != trust {
+		signature, err := ac.verifySignature(ctx, ref, manifest, manifestDigest)
+		if err != nil {
+			// timeouts and store failures say nothing about the image and are not cached
+			if cause := err.(*verificationError).cause; cause != causeTimeout && cause != causeStoreUnavailable && cause != causeStoreError {
+				ac.verdicts.add(key, &verdict{err: err, trust: trust}, ac.cache.NegativeTTL)
+			}
+			return err
+		}
+		cached = &verdict{signature: signature, trust: trust}
+		ac.verdicts.add(key, cached, ac.cache.TTL)
 	}
 
-	s = strings.SplitN(imagePath, ":", 2)
-	repo = s[0]
-	if len(s) > 1 {
-		tag = s[1]
-	} else {
-		tag = "latest"
+	v := cached.(*verdict)
+	if v.err != nil {
+		return v.err
+	}
+	if err := ac.verifyCommit(namespace, ref, v.signature); err != nil {
+		return err
+	}
+	return ac.verifyRoles(namespace, ref, v.signature)
+}
+
+// trustGeneration returns the generation of the trust anchors, reloading them once their refresh
+// period has passed. Trust stores and keyrings that do not reload have generation 0.
+func (ac *admissionController) trustGeneration() trustGeneration {
+	var trust trustGeneration
+	if r, ok := ac.trustStore.(validator.Reloading); ok {
+		trust.trustStore = r.Generation()
+	}
+	if r, ok := ac.keyring.(validator.Reloading); ok {
+		trust.keyring = r.Generation()
+	}
+	return trust
+}
+
+// verifySignature validates signatures of the image manifest until one is valid, and returns its
+// signature response. Returned errors are *verificationError, of the first signature if none is valid.
+func (ac *admissionController) verifySignature(ctx context.Context, ref *imageReference, manifest, manifestDigest string) (*validator.SignatureResponse, error) {
+	manifestSigs, err := getManifestSignatures(ctx, ac.signatureStore, ref, manifestDigest)
+	if ctx.Err() != nil {
+		return nil, newVerificationError(causeTimeout, "verification did not complete before the deadline")
+	}
+	if err != nil {
+		ac.logger.Errorf("api=verifyImage, reason=GetManifestSignature, image=%q, err=%v", ref, err)
+		switch errors.Cause(err) {
+		case ErrSignatureNotFound:
+			return nil, newVerificationError(causeSignatureMissing, "no signature of manifest %s in the signature store", manifestDigest)
+		case ErrAccessDenied:
+			return nil, newVerificationError(causeSignatureAccessDenied, "access to the manifest signature was denied by the signature store")
+		case ErrBackendUnavailable:
+			return nil, newVerificationError(causeStoreUnavailable, "signature store is unavailable")
+		default:
+			// misconfigured stores are denied whatever the unavailable policy
+			return nil, newVerificationError(causeStoreError, "failed to fetch manifest signature")
+		}
+	}
+
+	if len(manifestSigs) == 0 {
+		ac.logger.Errorf("api=verifyImage, reason='empty manifest signature', image=%q, manifest_digest=%q", ref, manifestDigest)
+		return nil, newVerificationError(causeSignatureMissing, "failed to fetch manifest signature")
+	}
+
+	var firstErr error
+	for _, manifestSig := range manifestSigs {
+		signature, err := ac.validateSignature(ref, manifest, manifestDigest, manifestSig)
+		if err == nil {
+			return signature, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// validateSignature validates the signature of the image manifest and returns the signature response.
+// Returned errors are *verificationError.
+func (ac *admissionController) validateSignature(ref *imageReference, manifest, manifestDigest, manifestSig string) (*validator.SignatureResponse, error) {
+	status, signedDigest, err := validator.ValidateManifestSignature(manifest, manifestSig, &validator.VerifyOptions{
+		TrustStore:     ac.trustStore,
+		Keyring:        ac.keyring,
+		SignerPolicy:   ac.policy.signerPolicy(ref),
+		HashAlgorithms: ac.policy.hashAlgorithms(ref),
+	})
+	if err != nil {
+		ac.logger.Errorf("api=verifyImage, reason=ValidateManifestSignature, image=%q, err=%v", ref, err)
+		switch errors.Cause(err) {
+		case validator.ErrSignatureNotFound:
+			return nil, newVerificationError(causeSignatureMissing, "no signature for manifest %s", manifestDigest)
+		case validator.ErrHashNotAllowed:
+			return nil, newVerificationError(causeHashNotAllowed, "manifest signature uses a hash algorithm that is not allowed for the image")
+		case validator.ErrUntrustedSigner:
+			return nil, newVerificationError(causeUntrustedChain, "signing certificate is not trusted")
+		case validator.ErrSignerNotAllowed:
+			return nil, newVerificationError(causeSignerNotAllowed, "signing certificate is not allowed to sign the image")
+		default:
+			return nil, newVerificationError(causeBadSignature, "failed to validate manifest signature")
+		}
+	}
+
+	if !status {
+		ac.logger.Errorf("api=verifyImage, reason=ValidateManifestSignature, status=%t, image=%q", status, ref)
+		return nil, newVerificationError(causeBadSignature, "failed to validate manifest signature")
+	}
+	ac.logger.Infof("api=verifyImage, reason='valid manifest signature', image=%q, manifest_digest=%q, signed_digest=%q", ref, manifestDigest, signedDigest)
+
+	// the signature was decoded by ValidateManifestSignature
+	signature, _ := validator.LoadSignatureResponse([]byte(manifestSig))
+	return signature, nil
+}
+
+// verifyCommit checks the commit of the signature response against commit policies of the image
+// and teams of the namespace. Returned errors are *verificationError.
+func (ac *admissionController) verifyCommit(namespace string, ref *imageReference, signature *validator.SignatureResponse) error {
+	var commit validator.GitCommitInfo
+	if signature != nil && signature.Commit != nil {
+		commit = *signature.Commit
+	}
+
+	if commitPolicy := ac.policy.commitPolicy(ref); commitPolicy != nil {
+		if commitPolicy.RequireApprover && commit.Approver == "" {
+			ac.logger.Errorf("api=verifyCommit, reason='no approver', image=%q, commit=%q", ref, commit.Commit)
+			return newVerificationError(causeCommitNotAllowed, "commit %q has no approver", commit.Commit)
+		}
+		if commitPolicy.RequireDistinctApprover && (commit.Approver == "" || strings.EqualFold(commit.Approver, commit.Author)) {
+			ac.logger.Errorf("api=verifyCommit, reason='approver is the author', image=%q, commit=%q, author=%q, approver=%q", ref, commit.Commit, commit.Author, commit.Approver)
+			return newVerificationError(causeCommitNotAllowed, "commit %q must be approved by someone other than its author", commit.Commit)
+		}
+		if len(commitPolicy.Repos) > 0 && !matchesAny(commitPolicy.Repos, commit.Repo) {
+			ac.logger.Errorf("api=verifyCommit, reason='repo not allowed', image=%q, commit=%q, repo=%q", ref, commit.Commit, commit.Repo)
+			return newVerificationError(causeCommitNotAllowed, "commit repo %q is not allowed for the image", commit.Repo)
+		}
+	}
+
+	if teams := ac.policy.namespaceTeams(namespace); teams != nil && !matchesAny(teams, commit.Team) {
+		ac.logger.Errorf("api=verifyCommit, reason='team not allowed', image=%q, namespace=%q, team=%q", ref, namespace, commit.Team)
+		return newVerificationError(causeCommitNotAllowed, "commit team %q is not allowed in namespace %q", commit.Team, namespace)
+	}
+	return nil
+}
+
+// verifyRoles checks the requestor and signer roles of the signature response against roles
+// of the namespace. Returned errors are *verificationError.
+func (ac *admissionController) verifyRoles(namespace string, ref *imageReference, signature *validator.SignatureResponse) error {
+	roles := ac.policy.namespaceRoles(namespace)
+	if roles == nil {
+		return nil
+	}
+
+	var requestor, signer validator.RoleInfo
+	if signature != nil && signature.Requestor != nil {
+		requestor = *signature.Requestor
+	}
+	if signature != nil && signature.Signer != nil {
+		signer = *signature.Signer
+	}
+
+	if len(roles.Requestors) > 0 && !matchesAny(roles.Requestors, requestor.Role) {
+		ac.logger.Errorf("api=verifyRoles, reason='requestor role not allowed', image=%q, namespace=%q, role=%q, host=%q, ip=%q", ref, namespace, requestor.Role, requestor.Host, requestor.IP)
+		return newVerificationError(causeRoleNotAllowed, "requestor role %q is not allowed in namespace %q", requestor.Role, namespace)
+	}
+	if len(roles.Signers) > 0 && !matchesAny(roles.Signers, signer.Role) {
+		ac.logger.Errorf("api=verifyRoles, reason='signer role not allowed', image=%q, namespace=%q, role=%q, host=%q, ip=%q", ref, namespace, signer.Role, signer.Host, signer.IP)
+		return newVerificationError(causeRoleNotAllowed, "signer role %q is not allowed in namespace %q", signer.Role, namespace)
 	}
-	return host, repo, tag
+	return nil
 }
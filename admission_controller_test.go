@@ -1,17 +1,41 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"git.soma.salesforce.com/kuleana/go-pkg/cms"
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func Test_NewAdmissionController(t *testing.T) {
 	region := "test_region"
 	bucket := "test_bucket"
 	var logger *logrus.Logger
-	aci, err := NewAdmissionController(region, bucket, logger)
+	aci, err := NewAdmissionController(region, bucket, DefaultPolicy(), nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
 	require.NoError(t, err)
 
 	ac, ok := aci.(*admissionController)
@@ -19,24 +43,826 @@ func Test_NewAdmissionController(t *testing.T) {
 
 	require.Equal(t, ac.region, region)
 	require.Equal(t, ac.bucket, bucket)
+	require.Equal(t, ac.policy, DefaultPolicy())
 }
 
-func Test_parseImage(t *testing.T) {
-	image := "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller:latest"
-	host, repo, tag := parseImage(image)
-	require.Equal(t, host, "684269065708.dkr.ecr.us-east-1.amazonaws.com")
-	require.Equal(t, repo, "stampy-webhook-admission-controller")
-	require.Equal(t, tag, "latest")
-
-	image = "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller/path1/path2:v1"
-	host, repo, tag = parseImage(image)
-	require.Equal(t, host, "684269065708.dkr.ecr.us-east-1.amazonaws.com")
-	require.Equal(t, repo, "stampy-webhook-admission-controller/path1/path2")
-	require.Equal(t, tag, "v1")
-
-	image = "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller/path1/path2@sha256:123456"
-	host, repo, tag = parseImage(image)
-	require.Equal(t, host, "684269065708.dkr.ecr.us-east-1.amazonaws.com")
-	require.Equal(t, repo, "stampy-webhook-admission-controller/path1/path2")
-	require.Equal(t, tag, "sha256:123456")
+func Test_MutateUnknownKind(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{}}`)},
+		},
+	}
+
+	policy := DefaultPolicy()
+	ac, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+
+	response := ac.Mutate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, `unsupported kind "Service"`, response.Result.Message)
+
+	policy.UnknownKinds = policyAllow
+	response = ac.Mutate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	require.Empty(t, response.Patch)
+}
+
+func Test_ValidateUnknownKind(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{}}`)},
+		},
+	}
+
+	policy := DefaultPolicy()
+	ac, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+
+	response := ac.Validate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, `unsupported kind "Service"`, response.Result.Message)
+
+	policy.UnknownKinds = policyAllow
+	response = ac.Validate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	require.Nil(t, response.Patch)
+	require.Nil(t, response.PatchType)
+}
+
+// fakeImageController serves manifests by image reference and signatures by manifest digest,
+// as both ImageControllerInterface and SignatureStore
+type fakeImageController struct {
+	manifests  map[string]string
+	signatures map[string]string
+	blocked    map[string]bool  // images that are not served until the context is done
+	failures   map[string]error // errors returned for images
+
+	signatureFailures map[string]error // errors returned for signatures of images
+}
+
+func (f *fakeImageController) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	if f.blocked[image.String()] {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	if err, ok := f.failures[image.String()]; ok {
+		return "", err
+	}
+	manifest, ok := f.manifests[image.String()]
+	if !ok {
+		return "", errors.NotFoundf("image %q", image)
+	}
+	return manifest, nil
+}
+
+func (f *fakeImageController) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	if err, ok := f.signatureFailures[image.String()]; ok {
+		return "", err
+	}
+	return f.signatures[digest], nil
+}
+
+// testSigner signs manifests with a code signing certificate issued by a test root
+type testSigner struct {
+	root *x509.Certificate
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	newCert := func(template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert, key
+	}
+
+	root, rootKey := newCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	cert, key := newCert(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "signer"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, root, rootKey)
+	return &testSigner{root: root, cert: cert, key: key}
+}
+
+// sign returns the signature response with a detached CMS signature of the manifest
+func (s *testSigner) sign(t *testing.T, manifest string, res validator.SignatureResponse) string {
+	der, err := cms.SignDetached([]byte(manifest), []*x509.Certificate{s.cert}, s.key)
+	require.NoError(t, err)
+	hash := sha256.Sum256([]byte(manifest))
+	res.Signatures = []*validator.SignatureInfo{
+		{
+			Name:            "manifest.json",
+			SignatureFormat: "cms-detached",
+			HashAlg:         "SHA256",
+			Hash:            hex.EncodeToString(hash[:]),
+			Signature:       base64.StdEncoding.EncodeToString(der),
+			Certificate:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})),
+		},
+	}
+	b, err := json.Marshal(&res)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// testImages serves manifests and their signatures to an admission controller
+// that trusts the signer
+type testImages struct {
+	*fakeImageController
+	signer *testSigner
+}
+
+// add serves the manifest for the image, and signs it with the signature response unless it is nil
+func (ti *testImages) add(t *testing.T, image, manifest string, res *validator.SignatureResponse) {
+	ti.manifests[image] = manifest
+	if res != nil {
+		ti.signatures[validator.SHA256Digest([]byte(manifest))] = ti.signer.sign(t, manifest, *res)
+	}
+}
+
+// newTestAdmissionController returns an admission controller with the policy, which reads
+// manifests and signatures from the returned test images
+func newTestAdmissionController(t *testing.T, policy *Policy) (*admissionController, *testImages) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	signer := newTestSigner(t)
+	trustStore := validator.NewTrustStore(func(context.Context) ([]*x509.Certificate, error) {
+		return []*x509.Certificate{signer.root}, nil
+	}, time.Hour)
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, trustStore, nil, nil, CacheConfig{Size: 10, TTL: time.Hour}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+
+	images := &testImages{
+		fakeImageController: &fakeImageController{manifests: map[string]string{}, signatures: map[string]string{}},
+		signer:              signer,
+	}
+	ac.imageManager, ac.signatureStore = images.fakeImageController, images.fakeImageController
+	return ac, images
+}
+
+func Test_MutateReportsAllFailures(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	aci, err := NewAdmissionController("test_region", "test_bucket", DefaultPolicy(), nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	fake := &fakeImageController{
+		manifests: map[string]string{
+			"registry/unsigned:v1": `{"schemaVersion":2}`,
+		},
+		failures: map[string]error{
+			"registry/rewritten:v1": errors.Annotate(errReportedDigestMismatch, "image=registry/rewritten:v1"),
+		},
+	}
+	ac.imageManager, ac.signatureStore = fake, fake
+
+	raw := `{"spec":{"template":{"spec":{
+		"initContainers":[{"name":"init","image":"registry/missing:v1"}],
+		"containers":[{"name":"app","image":"registry/unsigned:v1"},{"name":"proxy","image":"registry/rewritten:v1"}]
+	}}}}`
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Name:   "web",
+			Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Object: runtime.RawExtension{Raw: []byte(raw)},
+		},
+	}
+
+	response := ac.Mutate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, metav1.StatusReasonForbidden, response.Result.Reason)
+	require.Contains(t, response.Result.Message, "3 container image(s) failed verification")
+	require.NotNil(t, response.Result.Details)
+	require.Equal(t, "web", response.Result.Details.Name)
+
+	causes := response.Result.Details.Causes
+	require.Len(t, causes, 3)
+	require.Equal(t, causeManifestNotFound, causes[0].Type)
+	require.Equal(t, "spec.template.spec.initContainers[0].image", causes[0].Field)
+	require.Contains(t, causes[0].Message, `container "init", image "registry/missing:v1"`)
+	require.Equal(t, causeSignatureMissing, causes[1].Type)
+	require.Equal(t, "spec.template.spec.containers[0].image", causes[1].Field)
+	require.Equal(t, causeManifestRewritten, causes[2].Type)
+	require.Equal(t, "spec.template.spec.containers[1].image", causes[2].Field)
+}
+
+func Test_VerifyTimeout(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	policy := DefaultPolicy()
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	fake := &fakeImageController{
+		blocked: map[string]bool{"registry/slow:v1": true},
+	}
+	ac.imageManager, ac.signatureStore = fake, fake
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"slow","image":"registry/slow:v1"}]}}`)},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	response := ac.Validate(ctx, ar)
+	require.False(t, response.Allowed)
+	require.Len(t, response.Result.Details.Causes, 1)
+	require.Equal(t, causeTimeout, response.Result.Details.Causes[0].Type)
+
+	policy.Timeout = policyAllow
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	response = ac.Mutate(ctx, ar)
+	require.True(t, response.Allowed)
+	require.JSONEq(t, `[{"op":"add","path":"/metadata","value":{"annotations":{"stampy.io/unverified-images":"registry/slow:v1"}}}]`, string(response.Patch))
+}
+
+func Test_SignatureStoreErrors(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	policy := DefaultPolicy()
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{Size: 10, TTL: time.Hour, NegativeTTL: time.Hour}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	manifest := `{"schemaVersion":2}`
+	fake := &fakeImageController{
+		manifests: map[string]string{
+			"registry/missing:v1":     manifest,
+			"registry/denied:v1":      manifest,
+			"registry/unavailable:v1": manifest,
+			"registry/failing:v1":     manifest,
+		},
+		signatureFailures: map[string]error{
+			"registry/missing:v1":     errors.Annotate(ErrSignatureNotFound, "key=missing"),
+			"registry/denied:v1":      errors.Annotate(ErrAccessDenied, "key=denied"),
+			"registry/unavailable:v1": errors.Annotate(ErrBackendUnavailable, "throttled"),
+			"registry/failing:v1":     errors.New("template: key: executing"),
+		},
+	}
+	ac.imageManager, ac.signatureStore = fake, fake
+
+	testCases := []struct {
+		image       string
+		cause       metav1.CauseType
+		allowedWhen string // unavailable policy that admits the image
+	}{
+		{image: "registry/missing:v1", cause: causeSignatureMissing},
+		{image: "registry/denied:v1", cause: causeSignatureAccessDenied},
+		{image: "registry/unavailable:v1", cause: causeStoreUnavailable, allowedWhen: policyAllow},
+		{image: "registry/failing:v1", cause: causeStoreError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.image, func(t *testing.T) {
+			ar := &v1beta1.AdmissionReview{
+				Request: &v1beta1.AdmissionRequest{
+					Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"` + tc.image + `"}]}}`)},
+				},
+			}
+
+			policy.Unavailable = policyDeny
+			response := ac.Validate(context.Background(), ar)
+			require.False(t, response.Allowed)
+			require.Len(t, response.Result.Details.Causes, 1)
+			require.Equal(t, tc.cause, response.Result.Details.Causes[0].Type)
+
+			policy.Unavailable = policyAllow
+			response = ac.Validate(context.Background(), ar)
+			require.Equal(t, tc.allowedWhen == policyAllow, response.Allowed)
+		})
+	}
+}
+
+func Test_MisconfiguredSignatureStore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	// the base URL of the store is missing a path segment
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	policy := DefaultPolicy()
+	policy.Unavailable = policyAllow
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, newURLSignatureStore(srv.URL), CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	ac.imageManager = &fakeImageController{manifests: map[string]string{"registry/app:v1": `{"schemaVersion":2}`}}
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"registry/app:v1"}]}}`)},
+		},
+	}
+	response := ac.Mutate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, causeStoreError, response.Result.Details.Causes[0].Type)
+}
+
+func Test_FailurePolicies(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	policy := DefaultPolicy()
+	policy.FailurePolicies = []*FailurePolicy{
+		{Namespaces: []string{"dev-*"}, Unavailable: policyAllow},
+		{Images: []string{"registry/critical:*"}, Unavailable: policyDeny},
+	}
+	policy.Unavailable = policyAllow
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	fake := &fakeImageController{
+		manifests: map[string]string{
+			"registry/app:v1":      `{"schemaVersion":2}`,
+			"registry/critical:v1": `{"schemaVersion":2}`,
+		},
+		signatureFailures: map[string]error{
+			"registry/app:v1":      ErrBackendUnavailable,
+			"registry/critical:v1": ErrBackendUnavailable,
+		},
+	}
+	ac.imageManager, ac.signatureStore = fake, fake
+
+	testCases := []struct {
+		namespace string
+		image     string
+		allowed   bool
+	}{
+		{namespace: "dev-team", image: "registry/critical:v1", allowed: true},
+		{namespace: "prod", image: "registry/critical:v1", allowed: false},
+		{namespace: "prod", image: "registry/app:v1", allowed: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.namespace+"/"+tc.image, func(t *testing.T) {
+			ar := &v1beta1.AdmissionReview{
+				Request: &v1beta1.AdmissionRequest{
+					Namespace: tc.namespace,
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"app"},"spec":{"containers":[{"name":"app","image":"` + tc.image + `"}]}}`)},
+				},
+			}
+
+			allowed := metricValue(admissionMetrics, "allowed_unverified")
+			response := ac.Mutate(context.Background(), ar)
+			require.Equal(t, tc.allowed, response.Allowed)
+			if !tc.allowed {
+				require.Equal(t, causeStoreUnavailable, response.Result.Details.Causes[0].Type)
+				return
+			}
+			require.JSONEq(t, `[{"op":"add","path":"/metadata/annotations","value":{"stampy.io/unverified-images":"`+tc.image+`"}}]`, string(response.Patch))
+			require.NotEqual(t, allowed, metricValue(admissionMetrics, "allowed_unverified"))
+		})
+	}
+}
+
+func Test_AuditMode(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	policy := DefaultPolicy()
+	policy.NamespaceModes = []*NamespaceMode{
+		{Namespaces: []string{"team-a"}, Mode: modeAudit},
+		{Namespaces: []string{"team-c"}, Mode: modeWarn},
+	}
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	fake := &fakeImageController{
+		manifests: map[string]string{
+			"registry/unsigned:v1": `{"schemaVersion":2}`,
+		},
+	}
+	ac.imageManager, ac.signatureStore = fake, fake
+
+	review := func(namespace string) *v1beta1.AdmissionReview {
+		return &v1beta1.AdmissionReview{
+			Request: &v1beta1.AdmissionRequest{
+				Namespace: namespace,
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"annotations":{"team":"a"}},"spec":{"containers":[{"name":"app","image":"registry/unsigned:v1"}]}}`)},
+			},
+		}
+	}
+
+	response := ac.Mutate(context.Background(), review("team-a"))
+	require.True(t, response.Allowed)
+	require.JSONEq(t, `[{"op":"add","path":"/metadata/annotations/stampy.io~1verification","value":"failed"}]`, string(response.Patch))
+
+	response = ac.Validate(context.Background(), review("team-a"))
+	require.True(t, response.Allowed)
+	require.Empty(t, response.Warnings)
+	require.Equal(t, map[string]string{"verification": "failed"}, response.AuditAnnotations)
+
+	response = ac.Mutate(context.Background(), review("team-c"))
+	require.True(t, response.Allowed)
+	require.JSONEq(t, `[{"op":"add","path":"/metadata/annotations/stampy.io~1verification","value":"failed"}]`, string(response.Patch))
+	require.Len(t, response.Warnings, 1)
+	require.Contains(t, response.Warnings[0], `container "app", image "registry/unsigned:v1": SignatureMissing`)
+
+	response = ac.Mutate(context.Background(), review("team-b"))
+	require.False(t, response.Allowed)
+	require.Equal(t, causeSignatureMissing, response.Result.Details.Causes[0].Type)
+}
+
+func Test_AuditModeUnverifiableObjects(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.NamespaceModes = []*NamespaceMode{
+		{Namespaces: []string{"team-a"}, Mode: modeAudit},
+		{Namespaces: []string{"team-c"}, Mode: modeWarn},
+	}
+	ac, _ := newTestAdmissionController(t, policy)
+
+	testCases := []struct {
+		name    string
+		kind    string
+		object  string
+		message string
+	}{
+		{name: "UnknownKind", kind: "Service", object: `{"metadata":{"name":"app"},"spec":{}}`, message: `unsupported kind "Service"`},
+		{name: "UndecodableObject", kind: "Pod", object: `{"metadata":{"name":"app"},"spec":{"containers":{}}}`, message: "could not decode admission request object"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			review := func(namespace string) *v1beta1.AdmissionReview {
+				return &v1beta1.AdmissionReview{
+					Request: &v1beta1.AdmissionRequest{
+						Namespace: namespace,
+						Kind:      metav1.GroupVersionKind{Version: "v1", Kind: tc.kind},
+						Object:    runtime.RawExtension{Raw: []byte(tc.object)},
+					},
+				}
+			}
+
+			response := ac.Mutate(context.Background(), review("team-a"))
+			require.True(t, response.Allowed)
+			require.JSONEq(t, `[{"op":"add","path":"/metadata/annotations","value":{"stampy.io/verification":"failed"}}]`, string(response.Patch))
+
+			response = ac.Validate(context.Background(), review("team-a"))
+			require.True(t, response.Allowed)
+			require.Equal(t, map[string]string{"verification": "failed"}, response.AuditAnnotations)
+
+			response = ac.Validate(context.Background(), review("team-c"))
+			require.True(t, response.Allowed)
+			require.Equal(t, []string{"image verification failed: " + tc.message}, response.Warnings)
+
+			response = ac.Validate(context.Background(), review("team-b"))
+			require.False(t, response.Allowed)
+			require.Equal(t, tc.message, response.Result.Message)
+		})
+	}
+}
+
+// metricValue returns the value of the metric, 0 if it was never set
+func metricValue(metrics *expvar.Map, name string) string {
+	if v := metrics.Get(name); v != nil {
+		return v.String()
+	}
+	return "0"
+}
+
+func Test_VerdictCache(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	aci, err := NewAdmissionController("test_region", "test_bucket", DefaultPolicy(), nil, nil, nil, CacheConfig{Size: 10, TTL: time.Hour, NegativeTTL: time.Hour}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+
+	manifest := `{"schemaVersion":2}`
+	counter := &countingImageController{
+		fakeImageController: &fakeImageController{
+			manifests: map[string]string{
+				"registry/app:v1": manifest,
+			},
+			signatures: map[string]string{
+				validator.SHA256Digest([]byte(manifest)): "not a signature",
+			},
+		},
+	}
+	ac.imageManager, ac.signatureStore = counter, counter
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"registry/app:v1"},{"name":"sidecar","image":"registry/app:v1"}]}}`)},
+		},
+	}
+
+	response := ac.Validate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Len(t, response.Result.Details.Causes, 2)
+
+	// failed verdicts are cached, only the manifest digest is resolved again
+	response = ac.Validate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, causeBadSignature, response.Result.Details.Causes[0].Type)
+	require.Equal(t, 4, counter.manifests)
+	require.True(t, counter.signatures <= 2)
+
+	// verdicts are not reused once the trust anchors are reloaded with other roots
+	signatures := counter.signatures
+	trustStore := generationTrustStore(1)
+	ac.trustStore = &trustStore
+	response = ac.Validate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.True(t, counter.signatures > signatures)
+}
+
+// generationTrustStore is a trust store without roots that reports its value as generation
+type generationTrustStore uint64
+
+func (g *generationTrustStore) Roots() (*x509.CertPool, error) {
+	return x509.NewCertPool(), nil
+}
+
+func (g *generationTrustStore) Generation() uint64 {
+	return uint64(*g)
+}
+
+func Test_VerifyMultiArch(t *testing.T) {
+	amd64 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	arm64 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{}]}`
+	amd64Digest := validator.SHA256Digest([]byte(amd64))
+	arm64Digest := validator.SHA256Digest([]byte(arm64))
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + amd64Digest + `","platform":{"architecture":"amd64","os":"linux"}},
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + arm64Digest + `","platform":{"architecture":"arm64","os":"linux","variant":"v8"}}
+	]}`
+	indexDigest := validator.SHA256Digest([]byte(index))
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"registry/app:v1"}]}}`)},
+		},
+	}
+
+	newController := func(policy *Policy) (*admissionController, *testImages) {
+		ac, images := newTestAdmissionController(t, policy)
+		// the index and the amd64 manifest are signed
+		images.add(t, "registry/app:v1", index, &validator.SignatureResponse{})
+		images.add(t, "registry/app@"+amd64Digest, amd64, &validator.SignatureResponse{})
+		images.add(t, "registry/app@"+arm64Digest, arm64, nil)
+		return ac, images
+	}
+
+	t.Run("Index", func(t *testing.T) {
+		ac, _ := newController(DefaultPolicy())
+		response := ac.Mutate(context.Background(), ar)
+		require.True(t, response.Allowed)
+		require.Contains(t, string(response.Patch), "registry/app@"+indexDigest)
+	})
+
+	t.Run("Platforms", func(t *testing.T) {
+		policy := DefaultPolicy()
+		policy.MultiArch = multiArchPlatforms
+		ac, _ := newController(policy)
+		response := ac.Mutate(context.Background(), ar)
+		require.False(t, response.Allowed)
+		require.Len(t, response.Result.Details.Causes, 1)
+		require.Equal(t, causeSignatureMissing, response.Result.Details.Causes[0].Type)
+		require.Contains(t, response.Result.Details.Causes[0].Message, "platform linux/arm64/v8")
+	})
+
+	t.Run("PlatformDigestMismatch", func(t *testing.T) {
+		policy := DefaultPolicy()
+		policy.MultiArch = multiArchPlatforms
+		ac, images := newController(policy)
+		images.manifests["registry/app@"+amd64Digest] = arm64
+		response := ac.Mutate(context.Background(), ar)
+		require.False(t, response.Allowed)
+		require.Equal(t, causeDigestMismatch, response.Result.Details.Causes[0].Type)
+	})
+}
+
+// imageManifest returns a distinct manifest for the image
+func imageManifest(image string) string {
+	return `{"schemaVersion":2,"image":"` + image + `"}`
+}
+
+func Test_CommitPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.Commits = []*CommitPolicy{
+		{Images: []string{"registry/platform/*"}, RequireApprover: true, RequireDistinctApprover: true, Repos: []string{"github.com/org/platform-*"}},
+	}
+	policy.NamespaceTeams = []*NamespaceTeams{
+		{Namespaces: []string{"platform-*"}, Teams: []string{"platform"}},
+	}
+	ac, images := newTestAdmissionController(t, policy)
+
+	commits := map[string]*validator.GitCommitInfo{
+		"registry/platform/app:approved":   {Repo: "github.com/org/platform-app", Team: "platform", Author: "dev@example.com", Approver: "lead@example.com"},
+		"registry/platform/app:unapproved": {Repo: "github.com/org/platform-app", Team: "platform", Author: "dev@example.com"},
+		"registry/platform/app:self":       {Repo: "github.com/org/platform-app", Team: "platform", Author: "dev@example.com", Approver: "Dev@example.com"},
+		"registry/platform/app:fork":       {Repo: "github.com/dev/platform-app", Team: "platform", Author: "dev@example.com", Approver: "lead@example.com"},
+		"registry/team/app:v1":             {Repo: "github.com/org/app", Team: "team", Author: "dev@example.com"},
+	}
+	// every image is signed, with the commit in the signature response
+	for image, commit := range commits {
+		images.add(t, image, imageManifest(image), &validator.SignatureResponse{Commit: commit})
+	}
+	images.add(t, "registry/platform/app:unsigned", imageManifest("registry/platform/app:unsigned"), nil)
+
+	testCases := []struct {
+		namespace string
+		image     string
+		cause     metav1.CauseType
+		message   string
+	}{
+		{namespace: "platform-prod", image: "registry/platform/app:approved"},
+		{namespace: "platform-prod", image: "registry/platform/app:unapproved", cause: causeCommitNotAllowed, message: "has no approver"},
+		{namespace: "platform-prod", image: "registry/platform/app:self", cause: causeCommitNotAllowed, message: "must be approved by someone other than its author"},
+		{namespace: "platform-prod", image: "registry/platform/app:fork", cause: causeCommitNotAllowed, message: `commit repo "github.com/dev/platform-app" is not allowed`},
+		{namespace: "platform-prod", image: "registry/team/app:v1", cause: causeCommitNotAllowed, message: `commit team "team" is not allowed in namespace "platform-prod"`},
+		{namespace: "platform-prod", image: "registry/platform/app:unsigned", cause: causeSignatureMissing, message: "failed to fetch manifest signature"},
+		{namespace: "team", image: "registry/team/app:v1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.namespace+"/"+tc.image, func(t *testing.T) {
+			ar := &v1beta1.AdmissionReview{
+				Request: &v1beta1.AdmissionRequest{
+					Namespace: tc.namespace,
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Object:    runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"` + tc.image + `"}]}}`)},
+				},
+			}
+
+			response := ac.Validate(context.Background(), ar)
+			if tc.message == "" {
+				require.True(t, response.Allowed)
+				return
+			}
+			require.False(t, response.Allowed)
+			require.Equal(t, tc.cause, response.Result.Details.Causes[0].Type)
+			require.Contains(t, response.Result.Details.Causes[0].Message, tc.message)
+		})
+	}
+}
+
+func Test_EphemeralContainersSubresource(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.Mode = modeAudit
+	ac, images := newTestAdmissionController(t, policy)
+	manifest := `{"schemaVersion":2}`
+	digest := validator.SHA256Digest([]byte(manifest))
+	images.add(t, "registry/debug:v1", manifest, &validator.SignatureResponse{})
+
+	// the app image is not signed, but is not verified again for the subresource
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			SubResource: ephemeralContainersSubresource,
+			Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"app"},"spec":{
+				"containers":[{"name":"app","image":"registry/app:v1"}],
+				"ephemeralContainers":[{"name":"debugger","image":"registry/debug:v1"}]}}`)},
+		},
+	}
+
+	response := ac.Mutate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	require.JSONEq(t, `[{"op":"replace","path":"/spec/ephemeralContainers/0/image","value":"registry/debug@`+digest+`"}]`, string(response.Patch))
+
+	// failures of ephemeral containers are not annotated on the subresource
+	delete(images.manifests, "registry/debug:v1")
+	response = ac.Mutate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	require.Empty(t, response.Patch)
+
+	ar.Request.SubResource = ""
+	response = ac.Mutate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	require.Contains(t, string(response.Patch), verificationAnnotation)
+}
+
+func Test_RolePolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.NamespaceRoles = []*NamespaceRoles{
+		{Namespaces: []string{"prod-*"}, Requestors: []string{"ci-*"}, Signers: []string{"stampy-prod"}},
+	}
+	ac, images := newTestAdmissionController(t, policy)
+
+	signatures := map[string]*validator.SignatureResponse{
+		"registry/team/app:ci":     {Requestor: &validator.RoleInfo{Role: "ci-jenkins"}, Signer: &validator.RoleInfo{Role: "stampy-prod"}},
+		"registry/team/app:laptop": {Requestor: &validator.RoleInfo{Role: "developer", Host: "laptop"}, Signer: &validator.RoleInfo{Role: "stampy-prod"}},
+		"registry/team/app:dev":    {Requestor: &validator.RoleInfo{Role: "ci-jenkins"}, Signer: &validator.RoleInfo{Role: "stampy-dev"}},
+		"registry/team/app:none":   {},
+	}
+	// every image is signed, with the roles in the signature response
+	for image, signature := range signatures {
+		images.add(t, image, imageManifest(image), signature)
+	}
+
+	testCases := []struct {
+		namespace string
+		image     string
+		message   string
+	}{
+		{namespace: "prod-app", image: "registry/team/app:ci"},
+		{namespace: "prod-app", image: "registry/team/app:laptop", message: `requestor role "developer" is not allowed in namespace "prod-app"`},
+		{namespace: "prod-app", image: "registry/team/app:dev", message: `signer role "stampy-dev" is not allowed in namespace "prod-app"`},
+		{namespace: "prod-app", image: "registry/team/app:none", message: `requestor role "" is not allowed`},
+		{namespace: "dev", image: "registry/team/app:laptop"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.namespace+"/"+tc.image, func(t *testing.T) {
+			ar := &v1beta1.AdmissionReview{
+				Request: &v1beta1.AdmissionRequest{
+					Namespace: tc.namespace,
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Object:    runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"` + tc.image + `"}]}}`)},
+				},
+			}
+
+			response := ac.Validate(context.Background(), ar)
+			if tc.message == "" {
+				require.True(t, response.Allowed)
+				return
+			}
+			require.False(t, response.Allowed)
+			require.Equal(t, causeRoleNotAllowed, response.Result.Details.Causes[0].Type)
+			require.Contains(t, response.Result.Details.Causes[0].Message, tc.message)
+		})
+	}
+}
+
+// fakeMultiSignatureStore serves several signatures of manifests by manifest digest
+type fakeMultiSignatureStore map[string][]string
+
+func (f fakeMultiSignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	return f[digest][0], nil
+}
+
+func (f fakeMultiSignatureStore) GetManifestSignatures(ctx context.Context, image *imageReference, digest string) ([]string, error) {
+	return f[digest], nil
+}
+
+func Test_VerifySeveralSignatures(t *testing.T) {
+	ac, images := newTestAdmissionController(t, DefaultPolicy())
+	manifest := `{"schemaVersion":2}`
+	digest := validator.SHA256Digest([]byte(manifest))
+	images.add(t, "registry/app:v1", manifest, nil)
+
+	untrusted := newTestSigner(t).sign(t, manifest, validator.SignatureResponse{})
+	trusted := images.signer.sign(t, manifest, validator.SignatureResponse{Signer: &validator.RoleInfo{Role: "stampy-prod"}})
+
+	ar := &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"registry/app:v1"}]}}`)},
+		},
+	}
+
+	// signatures are validated until one is valid
+	ac.signatureStore = fakeMultiSignatureStore{digest: {untrusted, trusted}}
+	response := ac.Validate(context.Background(), ar)
+	require.True(t, response.Allowed)
+	signature, err := ac.verifySignature(context.Background(), parseImage("registry/app:v1"), manifest, digest)
+	require.NoError(t, err)
+	require.Equal(t, "stampy-prod", signature.Signer.Role)
+
+	// the error of the first signature is returned if none is valid
+	ac.verdicts = newLRUCache("verdicts", 0)
+	ac.signatureStore = fakeMultiSignatureStore{digest: {untrusted, `{}`}}
+	response = ac.Validate(context.Background(), ar)
+	require.False(t, response.Allowed)
+	require.Equal(t, causeUntrustedChain, response.Result.Details.Causes[0].Type)
 }
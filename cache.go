@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// cacheMetrics counts hits and misses of every cache, as <cache>_hits and <cache>_misses
+var cacheMetrics = expvar.NewMap("cache")
+
+// CacheConfig specifies size and lifetime of cached verification results
+type CacheConfig struct {
+	// Size specifies maximum number of entries of each cache, zero disables caching
+	Size int
+
+	// TTL specifies how long manifests, signatures and successful verdicts are cached
+	TTL time.Duration
+
+	// NegativeTTL specifies how long failed verdicts are cached
+	NegativeTTL time.Duration
+
+	// TagTTL specifies how long tags resolve to the same manifest digest
+	TagTTL time.Duration
+}
+
+// lruCache is a size bound cache of entries with expiry, evicting the least recently used entry
+type lruCache struct {
+	name string
+	size int
+
+	lock    sync.Mutex
+	entries *list.List // of *cacheEntry, most recently used first
+	items   map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// newLRUCache returns a cache of the size. The name identifies the cache in metrics.
+func newLRUCache(name string, size int) *lruCache {
+	cacheMetrics.Add(name+"_hits", 0)
+	cacheMetrics.Add(name+"_misses", 0)
+	return &lruCache{
+		name:    name,
+		size:    size,
+		entries: list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the value of the key, unless it is missing or expired
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[key]
+	if ok && time.Now().After(el.Value.(*cacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		cacheMetrics.Add(c.name+"_misses", 1)
+		return nil, false
+	}
+
+	cacheMetrics.Add(c.name+"_hits", 1)
+	c.entries.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// add adds the value of the key that expires after ttl
+func (c *lruCache) add(key string, value interface{}, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.value, entry.expires = value, expires
+		c.entries.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.entries.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for c.entries.Len() > c.size {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	c.entries.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lruCache(t *testing.T) {
+	c := newLRUCache("test", 2)
+
+	c.add("a", 1, time.Hour)
+	c.add("b", 2, time.Hour)
+	_, ok := c.get("a")
+	require.True(t, ok)
+
+	// b is the least recently used
+	c.add("c", 3, time.Hour)
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	v, ok := c.get("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.add("a", 4, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	_, ok = c.get("a")
+	assert.False(t, ok)
+
+	assert.Equal(t, "2", cacheMetrics.Get("test_hits").String())
+	assert.Equal(t, "2", cacheMetrics.Get("test_misses").String())
+
+	disabled := newLRUCache("disabled", 0)
+	disabled.add("a", 1, time.Hour)
+	_, ok = disabled.get("a")
+	assert.False(t, ok)
+}
+
+// countingImageController counts calls to the fake image controller
+type countingImageController struct {
+	*fakeImageController
+
+	lock       sync.Mutex
+	manifests  int
+	signatures int
+}
+
+func (c *countingImageController) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	c.lock.Lock()
+	c.manifests++
+	c.lock.Unlock()
+	return c.fakeImageController.GetManifest(ctx, image)
+}
+
+func (c *countingImageController) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	c.lock.Lock()
+	c.signatures++
+	c.lock.Unlock()
+	return c.fakeImageController.GetManifestSignature(ctx, image, digest)
+}
+
+func Test_cachingImageControllerAndSignatureStore(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	digest := validator.SHA256Digest([]byte(manifest))
+	signatures := map[string]string{}
+	counter := &countingImageController{
+		fakeImageController: &fakeImageController{
+			manifests: map[string]string{
+				"registry/app:v1": manifest,
+			},
+			signatures: signatures,
+		},
+	}
+	config := CacheConfig{Size: 10, TTL: time.Hour, NegativeTTL: time.Minute, TagTTL: time.Hour}
+	c := newCachingImageController(counter, config)
+	store := newCachingSignatureStore(counter, config)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		m, err := c.GetManifest(ctx, parseImage("registry/app:v1"))
+		require.NoError(t, err)
+		assert.Equal(t, manifest, m)
+	}
+	assert.Equal(t, 1, counter.manifests)
+
+	// the manifest is cached by its digest
+	m, err := c.GetManifest(ctx, parseImage("registry/app@"+digest))
+	require.NoError(t, err)
+	assert.Equal(t, manifest, m)
+	assert.Equal(t, 1, counter.manifests)
+
+	// missing signatures are not cached
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/app:v1"), digest)
+	require.NoError(t, err)
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/app:v1"), digest)
+	require.NoError(t, err)
+	assert.Equal(t, 2, counter.signatures)
+
+	signatures[digest] = "signature"
+	for i := 0; i < 3; i++ {
+		sig, err := store.GetManifestSignature(ctx, parseImage("registry/app:v1"), digest)
+		require.NoError(t, err)
+		assert.Equal(t, "signature", sig)
+	}
+	assert.Equal(t, 3, counter.signatures)
+}
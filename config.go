@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/kubernetes/pkg/util/file"
@@ -12,22 +14,45 @@ import (
 
 // Config encapsulates configurations related to the webhook
 type Config struct {
-	cert     string
-	key      string
-	logLevel logrus.Level
-	port     int
-	region   string
-	bucket   string
+	cert                string
+	key                 string
+	logLevel            logrus.Level
+	port                int
+	metricsPort         int
+	region              string
+	bucket              string
+	policy              *Policy
+	trustStore          string
+	keyring             string
+	signatureStore      string
+	s3Layout            *S3Layout
+	verificationTimeout time.Duration
+	cache               CacheConfig
+	registries          RegistryConfig
 }
 
 func readConfig() (*Config, error) {
 	f := flag.NewFlagSet("", flag.ExitOnError)
 	port := f.Int("port", 443, "Webhook server port.")
+	metricsPort := f.Int("metrics-port", 0, "Port of the plain HTTP server publishing metrics on /debug/vars, 0 disables it.")
 	logLevelStr := f.String("log-level", "debug", "Logging level.")
 	tlsPairName := f.String("tlsPairName", "tls", "certificate and key pair name")
 	tlsCertDir := f.String("tlsCertdir", "/var/run/stampy-webhook-admission-controller/certs", "certificate and key directory")
 	region := f.String("region", "", "AWS region that stores signature files.")
 	bucket := f.String("bucket", "", "AWS S3 bucket that stores signature files.")
+	trustStore := f.String("trust-store", "", "Trust anchors for signing certificates: file:<path>, dir:<path> or configmap:<namespace>/<name>.")
+	keyring := f.String("gpg-keyring", "", "OpenPGP keyring file, ASCII armored or binary, with public keys of gpg signatures. gpg signatures are rejected if not provided.")
+	signatureStore := f.String("signature-store", signatureStoreS3, "Store of manifest signatures: s3[:<bucket>], dir:<path>, url:<base URL> or oci. S3 store uses -bucket by default.")
+	s3LayoutFile := f.String("s3-layout", "", "S3 layout file with key template and bucket routes of signatures. Default layout is used if not provided.")
+	verificationTimeout := f.Duration("verification-timeout", 25*time.Second, "Maximum time to verify images of a request, further bound by the API server webhook timeout.")
+	cacheSize := f.Int("cache-size", 1024, "Maximum number of cached manifests, signatures and verdicts each, 0 disables caching.")
+	cacheTTL := f.Duration("cache-ttl", 10*time.Minute, "How long manifests, signatures and successful verdicts are cached.")
+	cacheNegativeTTL := f.Duration("cache-negative-ttl", 30*time.Second, "How long failed verdicts are cached.")
+	cacheTagTTL := f.Duration("cache-tag-ttl", time.Minute, "How long image tags resolve to a cached manifest digest.")
+	registries := f.String("registries", "", "Comma separated registries served with the Docker Registry v2 API, [http://|https://]<host>. Other registries are ECR.")
+	registryAuth := f.String("registry-auth", "", "Docker config file with credentials of the registries.")
+	registryTokenRealms := f.String("registry-token-realms", "", "Comma separated hosts of token realms, other than the registry hosts, that are sent registry credentials over https, for example auth.docker.io.")
+	policyFile := f.String("policy", "", "Admission policy file. Default policy is used if not provided.")
 	f.Parse(os.Args[1:])
 
 	certPath := path.Join(*tlsCertDir, *tlsPairName+".crt")
@@ -48,21 +73,81 @@ func readConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid region: empty")
 	}
 
-	if *bucket == "" {
+	storeKind, storeLocation, err := parseSignatureStore(*signatureStore)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature store: %v", err)
+	}
+
+	s3Layout := DefaultS3Layout()
+	if *s3LayoutFile != "" {
+		if s3Layout, err = LoadS3Layout(*s3LayoutFile); err != nil {
+			return nil, fmt.Errorf("invalid S3 layout: %v", err)
+		}
+	}
+
+	if *bucket == "" && storeKind == signatureStoreS3 && storeLocation == "" && s3Layout.Default.Bucket == "" {
 		return nil, fmt.Errorf("invalid bucket: empty")
 	}
 
+	if *trustStore == "" {
+		return nil, fmt.Errorf("invalid trust store: empty")
+	}
+
+	if _, _, err := parseTrustStore(*trustStore); err != nil {
+		return nil, fmt.Errorf("invalid trust store: %v", err)
+	}
+
+	var registryEndpoints []string
+	if *registries != "" {
+		registryEndpoints = strings.Split(*registries, ",")
+		for _, endpoint := range registryEndpoints {
+			if _, _, err := parseRegistryEndpoint(endpoint); err != nil {
+				return nil, fmt.Errorf("invalid registry: %v", err)
+			}
+		}
+	}
+
+	var tokenRealms []string
+	if *registryTokenRealms != "" {
+		tokenRealms = strings.Split(*registryTokenRealms, ",")
+	}
+
 	logLevel, err := logrus.ParseLevel(*logLevelStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid log level")
 	}
 
+	policy := DefaultPolicy()
+	if *policyFile != "" {
+		if policy, err = LoadPolicy(*policyFile); err != nil {
+			return nil, fmt.Errorf("invalid policy: %v", err)
+		}
+	}
+
 	return &Config{
-		port:     *port,
-		cert:     certPath,
-		key:      keyPath,
-		region:   *region,
-		bucket:   *bucket,
-		logLevel: logLevel,
+		port:                *port,
+		metricsPort:         *metricsPort,
+		cert:                certPath,
+		key:                 keyPath,
+		region:              *region,
+		bucket:              *bucket,
+		logLevel:            logLevel,
+		policy:              policy,
+		trustStore:          *trustStore,
+		keyring:             *keyring,
+		signatureStore:      *signatureStore,
+		s3Layout:            s3Layout,
+		verificationTimeout: *verificationTimeout,
+		cache: CacheConfig{
+			Size:        *cacheSize,
+			TTL:         *cacheTTL,
+			NegativeTTL: *cacheNegativeTTL,
+			TagTTL:      *cacheTagTTL,
+		},
+		registries: RegistryConfig{
+			Endpoints:   registryEndpoints,
+			AuthFile:    *registryAuth,
+			TokenRealms: tokenRealms,
+		},
 	}, nil
 }
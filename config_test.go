@@ -3,11 +3,19 @@ package main
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
+var defaultCacheConfig = CacheConfig{
+	Size:        1024,
+	TTL:         10 * time.Minute,
+	NegativeTTL: 30 * time.Second,
+	TagTTL:      time.Minute,
+}
+
 func TestSuiteConfigReader(t *testing.T) {
 
 	testCases := []struct {
@@ -18,68 +26,171 @@ func TestSuiteConfigReader(t *testing.T) {
 	}{
 		{
 			name:           "MissingBucket",
-			args:           []string{"x", "-region=test", "-tlsCertdir=", "-tlsPairName="},
+			args:           []string{"x", "-region=test", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: nil,
 			expectedError:  "invalid bucket: empty",
 		},
 		{
 			name:           "MissingRegion",
-			args:           []string{"x", "-bucket=test", "-tlsCertdir=", "-tlsPairName="},
+			args:           []string{"x", "-bucket=test", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: nil,
 			expectedError:  "invalid region: empty",
 		},
+		{
+			name:           "MissingTrustStore",
+			args:           []string{"x", "-region=test", "-bucket=test", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  "invalid trust store: empty",
+		},
+		{
+			name:           "InvalidTrustStore",
+			args:           []string{"x", "-region=test", "-bucket=test", "-trust-store=configmap:stampy", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  `invalid trust store: expected configmap:<namespace>/<name>, got "configmap:stampy"`,
+		},
+		{
+			name:           "InvalidSignatureStore",
+			args:           []string{"x", "-region=test", "-bucket=test", "-signature-store=dir:", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  `invalid signature store: expected dir:<path>, got "dir:"`,
+		},
+		{
+			name: "DirSignatureStoreWithoutBucket",
+			args: []string{"x", "-region=test_region", "-signature-store=dir:/var/lib/stampy/signatures", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: &Config{
+				cert:                ".crt",
+				key:                 ".key",
+				logLevel:            logrus.DebugLevel,
+				port:                443,
+				region:              "test_region",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "dir:/var/lib/stampy/signatures",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
+			},
+			expectedError: "",
+		},
+		{
+			name:           "MissingS3LayoutFile",
+			args:           []string{"x", "-region=test", "-bucket=test", "-s3-layout=/nonexistent/layout.yml", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  "invalid S3 layout: open /nonexistent/layout.yml: no such file or directory",
+		},
+		{
+			name:           "MissingPolicyFile",
+			args:           []string{"x", "-region=test", "-bucket=test", "-policy=/nonexistent/policy.yml", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  "invalid policy: open /nonexistent/policy.yml: no such file or directory",
+		},
 		{
 			name: "All",
-			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-tlsCertdir=", "-tlsPairName="},
+			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: &Config{
-				cert:     ".crt",
-				key:      ".key",
-				logLevel: logrus.DebugLevel,
-				port:     443,
-				region:   "test_region",
-				bucket:   "test_bucket",
+				cert:                ".crt",
+				key:                 ".key",
+				logLevel:            logrus.DebugLevel,
+				port:                443,
+				region:              "test_region",
+				bucket:              "test_bucket",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "s3",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
 			},
 			expectedError: "",
 		},
 		{
 			name: "LogLevel_Info",
-			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-log-level=info", "-tlsCertdir=", "-tlsPairName="},
+			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-log-level=info", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: &Config{
-				cert:     ".crt",
-				key:      ".key",
-				port:     443,
-				region:   "test_region",
-				bucket:   "test_bucket",
-				logLevel: logrus.InfoLevel,
+				cert:                ".crt",
+				key:                 ".key",
+				port:                443,
+				region:              "test_region",
+				bucket:              "test_bucket",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "s3",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
+				logLevel:            logrus.InfoLevel,
 			},
 			expectedError: "",
 		},
 		{
 			name: "LogLevel_Error",
-			args: []string{"x", "--region=test_region", "-bucket=test_bucket", "-log-level=error", "-tlsCertdir=", "-tlsPairName="},
+			args: []string{"x", "--region=test_region", "-bucket=test_bucket", "-log-level=error", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: &Config{
-				cert:     ".crt",
-				key:      ".key",
-				port:     443,
-				region:   "test_region",
-				bucket:   "test_bucket",
-				logLevel: logrus.ErrorLevel,
+				cert:                ".crt",
+				key:                 ".key",
+				port:                443,
+				region:              "test_region",
+				bucket:              "test_bucket",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "s3",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
+				logLevel:            logrus.ErrorLevel,
 			},
 			expectedError: "",
 		},
 		{
 			name: "Port",
-			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-log-level=error", "-port=17772", "-tlsCertdir=", "-tlsPairName="},
+			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-log-level=error", "-port=17772", "-metrics-port=9090", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
 			expectedConfig: &Config{
-				cert:     ".crt",
-				key:      ".key",
-				port:     17772,
-				region:   "test_region",
-				bucket:   "test_bucket",
+				cert:                ".crt",
+				key:                 ".key",
+				port:                17772,
+				metricsPort:         9090,
+				region:              "test_region",
+				bucket:              "test_bucket",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "s3",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
+				logLevel:            logrus.ErrorLevel,
+			},
+			expectedError: "",
+		},
+		{
+			name: "Registries",
+			args: []string{"x", "-region=test_region", "-bucket=test_bucket", "-log-level=error", "-registries=ghcr.io,http://localhost:5000", "-registry-auth=/etc/stampy/config.json", "-registry-token-realms=auth.docker.io", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: &Config{
+				cert:                ".crt",
+				key:                 ".key",
+				port:                443,
+				region:              "test_region",
+				bucket:              "test_bucket",
+				policy:              DefaultPolicy(),
+				trustStore:          "file:/etc/stampy/roots.pem",
+				signatureStore:      "s3",
+				s3Layout:            DefaultS3Layout(),
+				verificationTimeout: 25 * time.Second,
+				cache:               defaultCacheConfig,
+				registries: RegistryConfig{
+					Endpoints:   []string{"ghcr.io", "http://localhost:5000"},
+					AuthFile:    "/etc/stampy/config.json",
+					TokenRealms: []string{"auth.docker.io"},
+				},
 				logLevel: logrus.ErrorLevel,
 			},
 			expectedError: "",
 		},
+		{
+			name:           "InvalidRegistry",
+			args:           []string{"x", "-region=test", "-bucket=test", "-registries=ftp://registry", "-trust-store=file:/etc/stampy/roots.pem", "-tlsCertdir=", "-tlsPairName="},
+			expectedConfig: nil,
+			expectedError:  `invalid registry: expected [http://|https://]<host>, got "ftp://registry"`,
+		},
 	}
 
 	for _, tc := range testCases {
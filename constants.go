@@ -1,14 +1,22 @@
 package main
 
 const (
+	causeField      = "cause"
 	certFileField   = "certFile"
+	eventField      = "event"
+	fieldField      = "field"
 	isTLSField      = "isTls"
 	keyFileField    = "keyFile"
+	kindField       = "kind"
 	levelField      = "level"
 	logDateFormat   = "2006-01-02 15:04:05.999"
 	messageField    = "message"
 	methodField     = "method"
+	modeField       = "mode"
+	nameField       = "name"
+	namespaceField  = "namespace"
 	portField       = "port"
+	reasonField     = "reason"
 	remoteAddrField = "remoteAddr"
 	requestField    = "request"
 	timeField       = "time"
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+)
+
+// cachingImageController caches tag resolution and manifests of ImageControllerInterface.
+// Manifests are addressed by digest and do not change, tags may be moved to other
+// manifests and are cached for a shorter time.
+type cachingImageController struct {
+	ImageControllerInterface
+
+	config    CacheConfig
+	tags      *lruCache // manifest digest by image tag
+	manifests *lruCache // manifest by image digest
+}
+
+// newCachingImageController returns image controller that caches results of the controller
+func newCachingImageController(imageManager ImageControllerInterface, config CacheConfig) ImageControllerInterface {
+	return &cachingImageController{
+		ImageControllerInterface: imageManager,
+		config:                   config,
+		tags:                     newLRUCache("tags", config.Size),
+		manifests:                newLRUCache("manifests", config.Size),
+	}
+}
+
+// GetManifest returns manifest of the image, resolving its tag with the cache first
+func (c *cachingImageController) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	tag := ""
+	digest := image.Digest
+	if image.Tag != "" {
+		tag = image.Host + "/" + image.Repo + ":" + image.Tag
+		digest = ""
+		if cached, ok := c.tags.get(tag); ok {
+			digest = cached.(string)
+		} else if resolver, ok := c.ImageControllerInterface.(digestResolver); ok {
+			// resolving the tag is cheaper than fetching a manifest that may be cached
+			if resolved, err := resolver.ResolveDigest(ctx, image); err == nil {
+				digest = resolved
+			}
+		}
+	}
+
+	if digest != "" {
+		if manifest, ok := c.manifests.get(image.pinned(digest)); ok {
+			if tag != "" {
+				c.tags.add(tag, digest, c.config.TagTTL)
+			}
+			return manifest.(string), nil
+		}
+	}
+
+	manifest, err := c.ImageControllerInterface.GetManifest(ctx, image)
+	if err != nil {
+		return "", err
+	}
+
+	digest = validator.SHA256Digest([]byte(manifest))
+	if tag != "" {
+		c.tags.add(tag, digest, c.config.TagTTL)
+	}
+	c.manifests.add(image.pinned(digest), manifest, c.config.TTL)
+	return manifest, nil
+}
+
+// cachingSignatureStore caches signatures found in SignatureStore by image and manifest digest
+type cachingSignatureStore struct {
+	SignatureStore
+
+	config     CacheConfig
+	signatures *lruCache // signatures by repository and manifest digest
+}
+
+// newCachingSignatureStore returns signature store that caches signatures found in the store
+func newCachingSignatureStore(signatureStore SignatureStore, config CacheConfig) SignatureStore {
+	return &cachingSignatureStore{
+		SignatureStore: signatureStore,
+		config:         config,
+		signatures:     newLRUCache("signatures", config.Size),
+	}
+}
+
+// GetManifestSignature returns the first signature of the manifest, caching found signatures
+func (c *cachingSignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	sigs, err := c.GetManifestSignatures(ctx, image, digest)
+	if err != nil || len(sigs) == 0 {
+		return "", err
+	}
+	return sigs[0], nil
+}
+
+// GetManifestSignatures returns signatures of the manifest, caching found signatures
+func (c *cachingSignatureStore) GetManifestSignatures(ctx context.Context, image *imageReference, digest string) ([]string, error) {
+	key := image.pinned(digest)
+	if sigs, ok := c.signatures.get(key); ok {
+		return sigs.([]string), nil
+	}
+
+	sigs, err := getManifestSignatures(ctx, c.SignatureStore, image, digest)
+	if err != nil || len(sigs) == 0 {
+		return sigs, err
+	}
+
+	c.signatures.add(key, sigs, c.config.TTL)
+	return sigs, nil
+}
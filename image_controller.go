@@ -1,80 +1,100 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"sync"
 
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/juju/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// ecrHostRegex matches ECR registry hosts <account>.dkr.ecr.<region>.amazonaws.com
+var ecrHostRegex = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// errReportedDigestMismatch is returned for manifests whose digest differs from the digest reported
+// by the registry, which means the manifest was rewritten between the registry and the controller
+var errReportedDigestMismatch = errors.New("manifest digest differs from the digest reported by the registry")
+
 // ImageControllerInterface exposes image related operations
 type ImageControllerInterface interface {
-	GetManifest(string, string) (string, error)
-	GetManifestSignature(string, string) (string, error)
+	GetManifest(context.Context, *imageReference) (string, error)
 }
 
 // imageController implements image related operations for AWS
 type imageController struct {
 	region string
-	bucket string
 	logger *logrus.Logger
+
+	lock       sync.Mutex
+	ecrClients map[string]*ecr.ECR // ECR clients by region
 }
 
 // NewImageController constructor
-func NewImageController(region, bucket string, logger *logrus.Logger) ImageControllerInterface {
+func NewImageController(region string, logger *logrus.Logger) ImageControllerInterface {
+	return newImageController(region, logger)
+}
+
+func newImageController(region string, logger *logrus.Logger) *imageController {
 	return &imageController{
-		region: region,
-		bucket: bucket,
-		logger: logger,
+		region:     region,
+		logger:     logger,
+		ecrClients: make(map[string]*ecr.ECR),
 	}
 }
 
-// GetManifestSignature returns manifest signature of the image
-func (aim *imageController) GetManifestSignature(repo, digest string) (string, error) {
-	manifestSigURL := fmt.Sprintf("%s/%s/manifest.json.sig", repo, digest)
-	sess, err := aim.createSession()
-	if err != nil {
-		return "", errors.Trace(err)
+// parseECRHost returns registry ID and region of ECR registry host
+func parseECRHost(host string) (registryID, region string, ok bool) {
+	m := ecrHostRegex.FindStringSubmatch(host)
+	if m == nil {
+		return "", "", false
 	}
+	return m[1], m[2], true
+}
 
-	buf := aws.NewWriteAtBuffer([]byte{})
-	downloader := s3manager.NewDownloader(sess)
-	_, err = downloader.Download(buf,
-		&s3.GetObjectInput{
-			Bucket: aws.String(aim.bucket),
-			Key:    aws.String(manifestSigURL),
-		})
-	if err != nil {
-		errors.Errorf("api=GetManifestSignature, manifestSigURL=%q, err=%v", manifestSigURL, err)
+// GetManifest returns manifest of the image. Registry ID and region are taken from
+// ECR registry hosts, other hosts resolve against the default registry of the
+// configured region. Images referenced by tag are looked up by tag, even if
+// the reference also has a digest, so that callers can check the tag resolves
+// to that digest.
+func (aim *imageController) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	region := aim.region
+	registryID, ecrRegion, isECR := parseECRHost(image.Host)
+	if isECR {
+		region = ecrRegion
 	}
 
-	return string(buf.Bytes()), nil
-}
-
-// GetManifest returns manifest of the image
-func (aim *imageController) GetManifest(repo, tag string) (string, error) {
-	sess, err := aim.createSession()
+	ecrSvc, err := aim.ecrClient(region)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
 
-	ecrSvc := ecr.New(sess)
+	imageID := &ecr.ImageIdentifier{}
+	if image.Tag != "" {
+		imageID.ImageTag = aws.String(image.Tag)
+	} else {
+		imageID.ImageDigest = aws.String(image.Digest)
+	}
+
+	repo := image.Repo
 	inputBatchGetImage := &ecr.BatchGetImageInput{
-		ImageIds: []*ecr.ImageIdentifier{
-			{
-				ImageTag: aws.String(tag),
-			},
-		},
+		ImageIds:       []*ecr.ImageIdentifier{imageID},
 		RepositoryName: aws.String(repo),
+		// the format of the manifest, and so its digest, depends on accepted media types
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+	}
+	if isECR {
+		inputBatchGetImage.RegistryId = aws.String(registryID)
 	}
 
-	resultBatchGetImage, err := ecrSvc.BatchGetImage(inputBatchGetImage)
+	resultBatchGetImage, err := ecrSvc.BatchGetImageWithContext(ctx, inputBatchGetImage)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -88,24 +108,95 @@ func (aim *imageController) GetManifest(repo, tag string) (string, error) {
 				return "", errors.Errorf("api=BatchGetImage, err=%v", aerr.Error())
 			}
 		}
-		return "", errors.Errorf("api=BatchGetImage, repo=%q, tag=%q, err=%v", repo, tag, err)
+		return "", errors.Errorf("api=BatchGetImage, registryId=%q, region=%q, image=%q, err=%v", registryID, region, image, err)
 	}
 
 	if len(resultBatchGetImage.Images) == 0 {
-		return "", errors.Errorf("api=GetManifest, reason='failed to get any image with the specified parameters' repo=%q, tag=%q", repo, tag)
+		return "", errors.Errorf("api=GetManifest, reason='failed to get any image with the specified parameters' image=%q", image)
 	}
 
 	if len(resultBatchGetImage.Images) > 1 {
-		return "", errors.Errorf("api=GetManifest, reason='more than one image found with the specified parameters' repo=%q, tag=%q", repo, tag)
+		return "", errors.Errorf("api=GetManifest, reason='more than one image found with the specified parameters' image=%q", image)
+	}
+
+	result := resultBatchGetImage.Images[0]
+	manifest := aws.StringValue(result.ImageManifest)
+	var reported string
+	if result.ImageId != nil {
+		reported = aws.StringValue(result.ImageId.ImageDigest)
+	}
+	if err = checkReportedDigest(image, manifest, reported); err != nil {
+		return "", errors.Trace(err)
+	}
+	return manifest, nil
+}
+
+// checkReportedDigest returns errReportedDigestMismatch if the manifest digest differs
+// from the digest reported by the registry
+func checkReportedDigest(image *imageReference, manifest, reported string) error {
+	if reported == "" {
+		return nil
+	}
+	if digest, ok := validator.MatchDigest(reported, []byte(manifest)); !ok {
+		return errors.Annotatef(errReportedDigestMismatch, "image=%q, manifest_digest=%q, reported_digest=%q", image, digest, reported)
 	}
+	return nil
+}
+
+// ecrCredentials returns provider of registry credentials of the ECR registry host,
+// which are valid for 12 hours and so are requested again when the registry challenges
+func (aim *imageController) ecrCredentials(host string) credentialsProvider {
+	return func(ctx context.Context) (*registryCredentials, error) {
+		registryID, region, ok := parseECRHost(host)
+		if !ok {
+			return nil, errors.Errorf("api=ecrCredentials, reason='not an ECR host', host=%q", host)
+		}
+
+		ecrSvc, err := aim.ecrClient(region)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		result, err := ecrSvc.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
+			RegistryIds: aws.StringSlice([]string{registryID}),
+		})
+		if err != nil {
+			return nil, errors.Errorf("api=GetAuthorizationToken, registryId=%q, region=%q, err=%v", registryID, region, err)
+		}
+		if len(result.AuthorizationData) == 0 {
+			return nil, errors.Errorf("api=GetAuthorizationToken, reason='no authorization data', registryId=%q, region=%q", registryID, region)
+		}
 
-	return *resultBatchGetImage.Images[0].ImageManifest, nil
+		// the token is base64 encoded AWS:<password>
+		b, err := base64.StdEncoding.DecodeString(aws.StringValue(result.AuthorizationData[0].AuthorizationToken))
+		if err != nil {
+			return nil, errors.Annotatef(err, "api=GetAuthorizationToken, reason='invalid token', registryId=%q", registryID)
+		}
+		s := strings.SplitN(string(b), ":", 2)
+		if len(s) != 2 {
+			return nil, errors.Errorf("api=GetAuthorizationToken, reason='invalid token', registryId=%q", registryID)
+		}
+		return &registryCredentials{Username: s[0], Password: s[1]}, nil
+	}
 }
 
-func (aim *imageController) createSession() (*session.Session, error) {
+// ecrClient returns ECR client for the region, creating it on first use
+func (aim *imageController) ecrClient(region string) (*ecr.ECR, error) {
+	aim.lock.Lock()
+	defer aim.lock.Unlock()
+
+	if client, ok := aim.ecrClients[region]; ok {
+		return client, nil
+	}
+
 	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(aim.region),
+		Region: aws.String(region),
 	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	return sess, err
+	client := ecr.New(sess)
+	aim.ecrClients[region] = client
+	return client, nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseECRHost(t *testing.T) {
+	testCases := []struct {
+		host       string
+		registryID string
+		region     string
+		ok         bool
+	}{
+		{host: "684269065708.dkr.ecr.us-east-1.amazonaws.com", registryID: "684269065708", region: "us-east-1", ok: true},
+		{host: "121924372514.dkr.ecr.eu-central-1.amazonaws.com", registryID: "121924372514", region: "eu-central-1", ok: true},
+		{host: "121924372514.dkr.ecr-fips.us-gov-west-1.amazonaws.com", registryID: "121924372514", region: "us-gov-west-1", ok: true},
+		{host: "121924372514.dkr.ecr.cn-north-1.amazonaws.com.cn", registryID: "121924372514", region: "cn-north-1", ok: true},
+		{host: "12345.dkr.ecr.us-east-1.amazonaws.com"},
+		{host: "684269065708.dkr.ecr.us-east-1.amazonaws.com.example.com"},
+		{host: "docker.io"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			registryID, region, ok := parseECRHost(tc.host)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.registryID, registryID)
+			assert.Equal(t, tc.region, region)
+		})
+	}
+}
+
+func Test_checkReportedDigest(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	image := parseImage("registry/app:v1")
+
+	assert.NoError(t, checkReportedDigest(image, manifest, validator.SHA256Digest([]byte(manifest))))
+	assert.NoError(t, checkReportedDigest(image, manifest, ""))
+	sha512Digest, err := validator.Digest(validator.HashSHA512, []byte(manifest))
+	assert.NoError(t, err)
+	assert.NoError(t, checkReportedDigest(image, manifest, sha512Digest))
+
+	err = checkReportedDigest(image, manifest, validator.SHA256Digest([]byte(`{"schemaVersion":1}`)))
+	assert.Equal(t, errReportedDigestMismatch, errors.Cause(err))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultTag = "latest"
+
+// imageReference is a parsed container image reference
+// <host>/<repo>[:<tag>][@<digest>]
+type imageReference struct {
+	// Host specifies the registry host
+	Host string
+
+	// Repo specifies the repository name within the registry
+	Repo string
+
+	// Tag specifies the image tag, it is empty for references by digest only
+	Tag string
+
+	// Digest specifies the manifest digest prefixed with the algorithm, e.g. sha256:<hex>
+	Digest string
+}
+
+// parseImage parses an image reference. References with neither tag nor digest
+// refer to the latest tag.
+func parseImage(image string) *imageReference {
+	ref := new(imageReference)
+
+	s := strings.SplitN(image, "/", 2)
+	ref.Host = s[0]
+
+	imagePath := ""
+	if len(s) > 1 {
+		imagePath = s[1]
+	}
+
+	s = strings.SplitN(imagePath, "@", 2)
+	imagePath = s[0]
+	if len(s) > 1 {
+		ref.Digest = s[1]
+	}
+
+	// a colon after the last slash separates the tag
+	if i := strings.LastIndex(imagePath, ":"); i > strings.LastIndex(imagePath, "/") {
+		ref.Repo = imagePath[:i]
+		ref.Tag = imagePath[i+1:]
+	} else {
+		ref.Repo = imagePath
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref
+}
+
+// pinned returns the reference to the image by the digest
+func (r *imageReference) pinned(digest string) string {
+	return fmt.Sprintf("%s/%s@%s", r.Host, r.Repo, digest)
+}
+
+// String returns the reference in the canonical form
+func (r *imageReference) String() string {
+	s := r.Host + "/" + r.Repo
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseImage(t *testing.T) {
+	testCases := []struct {
+		image    string
+		expected imageReference
+	}{
+		{
+			image: "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller:latest",
+			expected: imageReference{
+				Host: "684269065708.dkr.ecr.us-east-1.amazonaws.com",
+				Repo: "stampy-webhook-admission-controller",
+				Tag:  "latest",
+			},
+		},
+		{
+			image: "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller",
+			expected: imageReference{
+				Host: "684269065708.dkr.ecr.us-east-1.amazonaws.com",
+				Repo: "stampy-webhook-admission-controller",
+				Tag:  "latest",
+			},
+		},
+		{
+			image: "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller/path1/path2:v1",
+			expected: imageReference{
+				Host: "684269065708.dkr.ecr.us-east-1.amazonaws.com",
+				Repo: "stampy-webhook-admission-controller/path1/path2",
+				Tag:  "v1",
+			},
+		},
+		{
+			image: "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller/path1/path2@sha256:123456",
+			expected: imageReference{
+				Host:   "684269065708.dkr.ecr.us-east-1.amazonaws.com",
+				Repo:   "stampy-webhook-admission-controller/path1/path2",
+				Digest: "sha256:123456",
+			},
+		},
+		{
+			image: "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy-webhook-admission-controller:v1@sha256:123456",
+			expected: imageReference{
+				Host:   "684269065708.dkr.ecr.us-east-1.amazonaws.com",
+				Repo:   "stampy-webhook-admission-controller",
+				Tag:    "v1",
+				Digest: "sha256:123456",
+			},
+		},
+		{
+			image: "localhost:5000/stampy-webhook-admission-controller:v1",
+			expected: imageReference{
+				Host: "localhost:5000",
+				Repo: "stampy-webhook-admission-controller",
+				Tag:  "v1",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.image, func(t *testing.T) {
+			ref := parseImage(tc.image)
+			assert.Equal(t, tc.expected, *ref)
+		})
+	}
+}
+
+func Test_imageReferenceString(t *testing.T) {
+	image := "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy/app:v1@sha256:123456"
+	assert.Equal(t, image, parseImage(image).String())
+
+	ref := parseImage("684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy/app:v1")
+	assert.Equal(t, "684269065708.dkr.ecr.us-east-1.amazonaws.com/stampy/app@sha256:123456", ref.pinned("sha256:123456"))
+}
@@ -34,10 +34,35 @@ func main() {
 		os.Exit(errorExitCode)
 	}
 
-	admissionController, err := NewAdmissionController(config.region, config.bucket, logger)
-	webhookServer := NewWebhookServer(admissionController, logger, certificateReader)
+	trustStore, err := NewTrustStore(config.trustStore)
+	if err != nil {
+		logger.Errorf("api=main, reason=NewTrustStore, err=%v", err)
+		os.Exit(errorExitCode)
+	}
+
+	keyring, err := NewKeyring(config.keyring)
+	if err != nil {
+		logger.Errorf("api=main, reason=NewKeyring, err=%v", err)
+		os.Exit(errorExitCode)
+	}
+
+	signatureStore, err := NewSignatureStore(config.signatureStore, config.region, config.bucket, config.s3Layout, config.registries, logger)
+	if err != nil {
+		logger.Errorf("api=main, reason=NewSignatureStore, err=%v", err)
+		os.Exit(errorExitCode)
+	}
+
+	admissionController, err := NewAdmissionController(config.region, config.bucket, config.policy, trustStore, keyring, signatureStore, config.cache, config.registries, logger)
+	if err != nil {
+		logger.Errorf("api=main, reason=NewAdmissionController, err=%v", err)
+		os.Exit(errorExitCode)
+	}
+	webhookServer := NewWebhookServer(admissionController, logger, certificateReader, config.verificationTimeout)
 
 	doneListeningChannel := webhookServer.Start(config.port)
+	if config.metricsPort > 0 {
+		webhookServer.StartMetrics(config.metricsPort)
+	}
 
 	// listening OS shutdown signal
 	signalChan := make(chan os.Signal, 1)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+)
+
+// Manifest media types accepted from registries
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestMediaTypes lists manifest media types in the order of preference
+var manifestMediaTypes = []string{
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifest,
+}
+
+// manifestHeader is the part of image manifests and indexes needed to tell them apart,
+// and to find layers of artifacts
+type manifestHeader struct {
+	SchemaVersion int                   `json:"schemaVersion"`
+	MediaType     string                `json:"mediaType,omitempty"`
+	ArtifactType  string                `json:"artifactType,omitempty"`
+	Manifests     []*manifestDescriptor `json:"manifests,omitempty"`
+	Layers        []*manifestDescriptor `json:"layers,omitempty"`
+}
+
+// manifestDescriptor describes a manifest of an index, or a layer of a manifest
+type manifestDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Platform     *manifestPlatform `json:"platform,omitempty"`
+}
+
+// manifestPlatform specifies the platform of a manifest in an index
+type manifestPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// parseManifest parses header of the manifest
+func parseManifest(manifest string) (*manifestHeader, error) {
+	header := new(manifestHeader)
+	if err := json.Unmarshal([]byte(manifest), header); err != nil {
+		return nil, errors.Annotate(err, "api=parseManifest, reason='invalid manifest'")
+	}
+	return header, nil
+}
+
+// isIndex returns true for Docker manifest lists and OCI image indexes.
+// The media type is optional in OCI indexes, which are then told by their manifests.
+func (m *manifestHeader) isIndex() bool {
+	switch m.MediaType {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		return true
+	case "":
+		return len(m.Manifests) > 0 && len(m.Layers) == 0
+	default:
+		return false
+	}
+}
+
+// String returns the platform as <os>/<architecture>[/<variant>]
+func (p *manifestPlatform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isIndex(t *testing.T) {
+	testCases := []struct {
+		name     string
+		manifest string
+		expected bool
+	}{
+		{
+			name:     "DockerManifestList",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[]}`,
+			expected: true,
+		},
+		{
+			name:     "OCIIndex",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`,
+			expected: true,
+		},
+		{
+			name:     "OCIIndexWithoutMediaType",
+			manifest: `{"schemaVersion":2,"manifests":[{"digest":"sha256:0"}]}`,
+			expected: true,
+		},
+		{
+			name:     "DockerManifest",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`,
+			expected: false,
+		},
+		{
+			name:     "OCIManifestWithoutMediaType",
+			manifest: `{"schemaVersion":2,"config":{},"layers":[{}]}`,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := parseManifest(tc.manifest)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, header.isIndex())
+		})
+	}
+
+	_, err := parseManifest("not a manifest")
+	require.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// signatureArtifactType is the artifact type of manifests of signatures stored in registries
+	signatureArtifactType = "application/vnd.stampy.signature.v1"
+
+	// signatureMediaType is the media type of the layer with the Stampy SignatureResponse
+	signatureMediaType = "application/vnd.stampy.signature.v1+json"
+)
+
+// ociSignatureStore provides signatures stored as OCI artifacts in the registry of the image.
+// Signature manifests refer to the image manifest and are found with the referrers API,
+// or by the tag <algorithm>-<hex>.sig on registries without the referrers API.
+type ociSignatureStore struct {
+	registries   map[string]*registryClient // clients of the configured registries by host
+	imageManager *imageController           // provides credentials of ECR registries
+	logger       *logrus.Logger
+
+	lock    sync.Mutex
+	clients map[string]*registryClient // clients of ECR registries by host
+}
+
+// newOCISignatureStore returns store of signatures in the configured registries and in ECR registries
+func newOCISignatureStore(region string, config RegistryConfig, logger *logrus.Logger) (*ociSignatureStore, error) {
+	registries, err := newRegistryClients(config, logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &ociSignatureStore{
+		registries:   registries,
+		imageManager: newImageController(region, logger),
+		logger:       logger,
+		clients:      make(map[string]*registryClient),
+	}, nil
+}
+
+// signatureTag returns the tag of the signature of the manifest with the digest, <algorithm>-<hex>.sig
+func signatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// GetManifestSignature returns the first manifest signature of the image
+func (s *ociSignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	signatures, err := s.GetManifestSignatures(ctx, image, digest)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return signatures[0], nil
+}
+
+// GetManifestSignatures returns manifest signatures of every signature artifact referring to the image
+// manifest, or of the artifact tagged for it on registries without the referrers API. Artifacts whose
+// signature cannot be fetched are skipped, unless none can be.
+func (s *ociSignatureStore) GetManifestSignatures(ctx context.Context, image *imageReference, digest string) ([]string, error) {
+	client, err := s.client(image.Host)
+	if err != nil {
+		return nil, errors.Annotatef(err, "api=GetManifestSignatures, image=%q", image)
+	}
+
+	artifacts := []*imageReference{{Host: image.Host, Repo: image.Repo, Tag: signatureTag(digest)}}
+	referrers, err := client.GetReferrers(ctx, image.Repo, digest, signatureArtifactType)
+	switch {
+	case errors.IsNotFound(errors.Cause(err)):
+		s.logger.Debugf("api=GetManifestSignatures, reason='no referrers API', image=%q, tag=%q", image, artifacts[0].Tag)
+	case err != nil:
+		return nil, errors.Annotatef(registryError(err), "api=GetManifestSignatures, image=%q, err=%v", image, err)
+	case len(referrers) > 0:
+		artifacts = artifacts[:0]
+		for _, referrer := range referrers {
+			artifacts = append(artifacts, &imageReference{Host: image.Host, Repo: image.Repo, Digest: referrer.Digest})
+		}
+	}
+
+	var signatures []string
+	var firstErr error
+	for _, artifact := range artifacts {
+		sig, err := s.getSignature(ctx, client, image, artifact)
+		if err != nil {
+			s.logger.Warnf("api=GetManifestSignatures, reason=getSignature, image=%q, signature=%q, err=%v", image, artifact, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		signatures = append(signatures, sig)
+	}
+	if len(signatures) == 0 {
+		return nil, firstErr
+	}
+	return signatures, nil
+}
+
+// getSignature returns the signature of the image in the signature artifact
+func (s *ociSignatureStore) getSignature(ctx context.Context, client *registryClient, image, signature *imageReference) (string, error) {
+	manifest, err := client.GetManifest(ctx, signature)
+	if err != nil {
+		return "", errors.Annotatef(registryError(err), "api=getSignature, image=%q, signature=%q, err=%v", image, signature, err)
+	}
+	if _, ok := validator.MatchDigest(signature.Digest, []byte(manifest)); signature.Digest != "" && !ok {
+		return "", errors.Annotatef(ErrSignatureNotFound, "api=getSignature, reason='signature manifest digest mismatch', image=%q, signature=%q", image, signature)
+	}
+
+	layer, err := signatureLayer(manifest)
+	if err != nil {
+		return "", errors.Annotatef(ErrSignatureNotFound, "api=getSignature, image=%q, signature=%q, err=%v", image, signature, err)
+	}
+
+	b, err := client.GetBlob(ctx, image.Repo, layer.Digest)
+	if err != nil {
+		return "", errors.Annotatef(registryError(err), "api=getSignature, image=%q, signature=%q, err=%v", image, signature, err)
+	}
+	return string(b), nil
+}
+
+// registryError returns the signature store error of the registry client error, or the error
+// itself if it is not known to be one of them. Signatures that are missing or do not match their
+// digest are not found.
+func registryError(err error) error {
+	switch {
+	case errors.IsNotFound(err), errors.IsNotValid(err):
+		return ErrSignatureNotFound
+	case errors.IsUnauthorized(err), errors.IsForbidden(err):
+		return ErrAccessDenied
+	case errors.Cause(err) == errRegistryUnavailable:
+		return ErrBackendUnavailable
+	default:
+		return err
+	}
+}
+
+// signatureLayer returns the layer of the signature manifest with the SignatureResponse
+func signatureLayer(manifest string) (*manifestDescriptor, error) {
+	header, err := parseManifest(manifest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, layer := range header.Layers {
+		if layer.MediaType == signatureMediaType {
+			return layer, nil
+		}
+	}
+	return nil, errors.Errorf("api=signatureLayer, reason='no layer of media type %s'", signatureMediaType)
+}
+
+// client returns client of the registry host. ECR registries are authenticated with ECR
+// authorization tokens, signatures of registries that are not configured are not found.
+func (s *ociSignatureStore) client(host string) (*registryClient, error) {
+	if client, ok := s.registries[host]; ok {
+		return client, nil
+	}
+	if _, _, ok := parseECRHost(host); !ok {
+		return nil, errors.Annotatef(ErrSignatureNotFound, "api=client, reason='registry is not configured', host=%q", host)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if client, ok := s.clients[host]; ok {
+		return client, nil
+	}
+
+	client, err := newRegistryClient("https://"+host, s.imageManager.ecrCredentials(host), nil, s.logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.clients[host] = client
+	return client, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestArtifactRegistry returns registry serving the signature of the image manifest with the digest
+// as an OCI artifact, found with the referrers API, or by tag if referrers is false
+func newTestArtifactRegistry(t *testing.T, repo, digest, signature string, referrers bool) *httptest.Server {
+	blobDigest := validator.SHA256Digest([]byte(signature))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"artifactType":%q,"layers":[{"mediaType":%q,"digest":%q}],"subject":{"digest":%q}}`,
+		mediaTypeOCIManifest, signatureArtifactType, signatureMediaType, blobDigest, digest)
+	manifestDigest := validator.SHA256Digest([]byte(manifest))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prefix := "/v2/" + repo + "/"
+		switch strings.TrimPrefix(req.URL.Path, prefix) {
+		case "referrers/" + digest:
+			if !referrers {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			fmt.Fprintf(w, `{"schemaVersion":2,"manifests":[{"mediaType":%q,"artifactType":"application/example","digest":"sha256:0123"},{"mediaType":%q,"artifactType":%q,"digest":%q}]}`,
+				mediaTypeOCIManifest, mediaTypeOCIManifest, signatureArtifactType, manifestDigest)
+		case "manifests/" + manifestDigest:
+			fmt.Fprint(w, manifest)
+		case "manifests/" + signatureTag(digest):
+			if referrers {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, manifest)
+		case "blobs/" + blobDigest:
+			fmt.Fprint(w, signature)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func Test_ociSignatureStore(t *testing.T) {
+	digest := validator.SHA256Digest([]byte(`{"schemaVersion":2}`))
+	ctx := context.Background()
+
+	testCases := []struct {
+		name      string
+		referrers bool
+	}{
+		{name: "Referrers", referrers: true},
+		{name: "Tag", referrers: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := newTestArtifactRegistry(t, "team/app", digest, "signature", tc.referrers)
+			defer registry.Close()
+
+			store, err := newOCISignatureStore("us-east-2", RegistryConfig{Endpoints: []string{registry.URL}}, logrus.New())
+			require.NoError(t, err)
+			host := strings.TrimPrefix(registry.URL, "http://")
+
+			sig, err := store.GetManifestSignature(ctx, parseImage(host+"/team/app:v1"), digest)
+			require.NoError(t, err)
+			assert.Equal(t, "signature", sig)
+
+			_, err = store.GetManifestSignature(ctx, parseImage(host+"/team/other:v1"), digest)
+			assert.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+		})
+	}
+}
+
+func Test_ociSignatureStoreErrors(t *testing.T) {
+	digest := validator.SHA256Digest([]byte(`{"schemaVersion":2}`))
+	ctx := context.Background()
+
+	signatures := newTestArtifactRegistry(t, "team/app", digest, "signature", true)
+	defer signatures.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/v2/team/unauthorized/"):
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasPrefix(req.URL.Path, "/v2/team/forbidden/"):
+			w.WriteHeader(http.StatusForbidden)
+		case strings.HasPrefix(req.URL.Path, "/v2/team/unavailable/"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case strings.HasPrefix(req.URL.Path, "/v2/team/tampered/blobs/"):
+			fmt.Fprint(w, "tampered")
+		default:
+			// serve the signature of team/app under other repositories
+			req.URL.Path = strings.Replace(req.URL.Path, "/v2/team/tampered/", "/v2/team/app/", 1)
+			resp, err := http.Get(signatures.URL + req.URL.Path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}
+	}))
+	defer registry.Close()
+
+	store, err := newOCISignatureStore("us-east-2", RegistryConfig{Endpoints: []string{registry.URL}}, logrus.New())
+	require.NoError(t, err)
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	testCases := []struct {
+		repo     string
+		expected error
+	}{
+		{repo: "team/unauthorized", expected: ErrAccessDenied},
+		{repo: "team/forbidden", expected: ErrAccessDenied},
+		{repo: "team/unavailable", expected: ErrBackendUnavailable},
+		{repo: "team/tampered", expected: ErrSignatureNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.repo, func(t *testing.T) {
+			_, err := store.GetManifestSignature(ctx, parseImage(host+"/"+tc.repo+":v1"), digest)
+			assert.Equal(t, tc.expected, errors.Cause(err))
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+		store, err := newOCISignatureStore("us-east-2", RegistryConfig{Endpoints: []string{unreachable.URL}}, logrus.New())
+		require.NoError(t, err)
+
+		_, err = store.GetManifestSignature(ctx, parseImage(strings.TrimPrefix(unreachable.URL, "http://")+"/team/app:v1"), digest)
+		assert.Equal(t, ErrBackendUnavailable, errors.Cause(err))
+	})
+}
+
+func Test_ociSignatureStoreReferrers(t *testing.T) {
+	digest := validator.SHA256Digest([]byte(`{"schemaVersion":2}`))
+	ctx := context.Background()
+
+	// the first referrer cannot be fetched, the others are returned in order
+	artifacts := map[string]string{}
+	var referrers []string
+	for _, signature := range []string{"", "first", "second"} {
+		blobDigest := validator.SHA256Digest([]byte(signature))
+		manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"artifactType":%q,"layers":[{"mediaType":%q,"digest":%q}]}`,
+			mediaTypeOCIManifest, signatureArtifactType, signatureMediaType, blobDigest)
+		manifestDigest := validator.SHA256Digest([]byte(manifest))
+		if signature != "" {
+			artifacts["manifests/"+manifestDigest] = manifest
+			artifacts["blobs/"+blobDigest] = signature
+		}
+		referrers = append(referrers, fmt.Sprintf(`{"mediaType":%q,"artifactType":%q,"digest":%q}`, mediaTypeOCIManifest, signatureArtifactType, manifestDigest))
+	}
+	artifacts["referrers/"+digest] = `{"schemaVersion":2,"manifests":[` + strings.Join(referrers, ",") + `]}`
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		artifact, ok := artifacts[strings.TrimPrefix(req.URL.Path, "/v2/team/app/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, artifact)
+	}))
+	defer registry.Close()
+
+	store, err := newOCISignatureStore("us-east-2", RegistryConfig{Endpoints: []string{registry.URL}}, logrus.New())
+	require.NoError(t, err)
+	image := parseImage(strings.TrimPrefix(registry.URL, "http://") + "/team/app:v1")
+
+	sigs, err := store.GetManifestSignatures(ctx, image, digest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, sigs)
+
+	sig, err := store.GetManifestSignature(ctx, image, digest)
+	require.NoError(t, err)
+	assert.Equal(t, "first", sig)
+}
+
+func Test_ociSignatureStoreUnconfiguredRegistry(t *testing.T) {
+	digest := validator.SHA256Digest([]byte(`{"schemaVersion":2}`))
+
+	var requests int
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer registry.Close()
+
+	store, err := newOCISignatureStore("us-east-2", RegistryConfig{}, logrus.New())
+	require.NoError(t, err)
+
+	_, err = store.GetManifestSignature(context.Background(), parseImage(strings.TrimPrefix(registry.URL, "https://")+"/team/app:v1"), digest)
+	assert.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+	assert.Equal(t, 0, requests)
+}
+
+func Test_signatureTag(t *testing.T) {
+	assert.Equal(t, "sha256-0123.sig", signatureTag("sha256:0123"))
+}
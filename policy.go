@@ -0,0 +1,497 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// Enforcement modes of failed verification
+const (
+	// modeEnforce denies requests with images that failed verification
+	modeEnforce = "enforce"
+	// modeAudit allows requests with images that failed verification, records the failures and annotates the object
+	modeAudit = "audit"
+	// modeWarn also returns the failures as warnings to the client
+	modeWarn = "warn"
+)
+
+// Verification of multi-arch images
+const (
+	// multiArchIndex requires the signature of the index only
+	multiArchIndex = "index"
+	// multiArchPlatforms also requires signatures of every platform manifest of the index
+	multiArchPlatforms = "platforms"
+)
+
+// Policy encapsulates admission decisions that are not made by signature verification
+type Policy struct {
+	// UnknownKinds specifies the decision for kinds with no known pod spec location [allow|deny]
+	UnknownKinds string `json:"unknownKinds"`
+
+	// Timeout specifies the decision for images not verified before the request deadline [allow|deny]
+	Timeout string `json:"timeout"`
+
+	// Unavailable specifies the decision for images whose signature store is unavailable [allow|deny]
+	Unavailable string `json:"unavailable"`
+
+	// MultiArch specifies how images with a manifest list or an OCI index are verified [index|platforms]
+	MultiArch string `json:"multiArch"`
+
+	// FailurePolicies override Timeout and Unavailable for images of matching namespaces and image patterns.
+	// The first matching failure policy is used.
+	FailurePolicies []*FailurePolicy `json:"failurePolicies,omitempty"`
+
+	// Mode specifies how failed verification is enforced [enforce|audit|warn]
+	Mode string `json:"mode"`
+
+	// NamespaceModes override Mode for matching namespaces. The first matching namespace mode is used.
+	NamespaceModes []*NamespaceMode `json:"namespaceModes,omitempty"`
+
+	// Signers specifies signing certificates allowed to sign matching images. The first matching
+	// signer policy is used, images with no matching signer policy may be signed by any trusted certificate.
+	Signers []*ImageSignerPolicy `json:"signers,omitempty"`
+
+	// HashAlgorithms specifies hash algorithms allowed in signatures of manifests [sha256|sha384|sha512],
+	// any of them if empty
+	HashAlgorithms []string `json:"hashAlgorithms,omitempty"`
+
+	// HashPolicies override HashAlgorithms for matching images. The first matching hash policy is used.
+	HashPolicies []*HashPolicy `json:"hashPolicies,omitempty"`
+
+	// Commits specifies commit metadata required of signatures of matching images.
+	// The first matching commit policy is used.
+	Commits []*CommitPolicy `json:"commits,omitempty"`
+
+	// NamespaceTeams specifies teams whose commits may be admitted to matching namespaces.
+	// The first matching namespace teams are used, other namespaces admit any team.
+	NamespaceTeams []*NamespaceTeams `json:"namespaceTeams,omitempty"`
+
+	// NamespaceRoles specifies Stampy roles of requestors and signers of signatures admitted to matching
+	// namespaces. The first matching namespace roles are used, other namespaces admit any role.
+	NamespaceRoles []*NamespaceRoles `json:"namespaceRoles,omitempty"`
+
+	// ContainerLists specifies policy per container list [containers|initContainers|ephemeralContainers]
+	ContainerLists map[string]*ContainerListPolicy `json:"containerLists,omitempty"`
+}
+
+// HashPolicy specifies hash algorithms allowed in signatures of images
+type HashPolicy struct {
+	// Images specifies image patterns <host>/<repo>. Patterns use path.Match syntax.
+	Images []string `json:"images"`
+
+	// Algorithms specifies the allowed hash algorithms [sha256|sha384|sha512]
+	Algorithms []string `json:"algorithms"`
+}
+
+// CommitPolicy specifies commit metadata required of signatures of images
+type CommitPolicy struct {
+	// Images specifies image patterns <host>/<repo>. Patterns use path.Match syntax.
+	Images []string `json:"images"`
+
+	// RequireApprover requires the commit to have an approver
+	RequireApprover bool `json:"requireApprover,omitempty"`
+
+	// RequireDistinctApprover requires the commit to have an approver other than its author
+	RequireDistinctApprover bool `json:"requireDistinctApprover,omitempty"`
+
+	// Repos specifies patterns of allowed commit repos. Patterns use path.Match syntax.
+	Repos []string `json:"repos,omitempty"`
+}
+
+// NamespaceTeams specifies teams whose commits may be admitted to namespaces
+type NamespaceTeams struct {
+	// Namespaces specifies namespace patterns. Patterns use path.Match syntax.
+	Namespaces []string `json:"namespaces"`
+
+	// Teams specifies patterns of allowed commit teams. Patterns use path.Match syntax.
+	Teams []string `json:"teams"`
+}
+
+// NamespaceRoles specifies Stampy roles of signatures admitted to namespaces
+type NamespaceRoles struct {
+	// Namespaces specifies namespace patterns. Patterns use path.Match syntax.
+	Namespaces []string `json:"namespaces"`
+
+	// Requestors specifies patterns of allowed requestor roles, any role if empty. Patterns use path.Match syntax.
+	Requestors []string `json:"requestors,omitempty"`
+
+	// Signers specifies patterns of allowed signer roles, any role if empty. Patterns use path.Match syntax.
+	Signers []string `json:"signers,omitempty"`
+}
+
+// ImageSignerPolicy specifies signing certificates allowed to sign images
+type ImageSignerPolicy struct {
+	// Images specifies image patterns <host>/<repo>. Patterns use path.Match syntax.
+	Images []string `json:"images"`
+
+	validator.SignerPolicy `json:",inline"`
+}
+
+// NamespaceMode specifies the enforcement mode of namespaces
+type NamespaceMode struct {
+	// Namespaces specifies namespace patterns. Patterns use path.Match syntax.
+	Namespaces []string `json:"namespaces"`
+
+	// Mode specifies how failed verification is enforced in the namespaces [enforce|audit|warn]
+	Mode string `json:"mode"`
+}
+
+// FailurePolicy specifies decisions for images that could not be verified
+type FailurePolicy struct {
+	// Namespaces specifies namespace patterns, any namespace if empty. Patterns use path.Match syntax.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Images specifies image patterns, any image if empty. Patterns use path.Match syntax.
+	Images []string `json:"images,omitempty"`
+
+	// Timeout overrides the timeout decision of the policy, if not empty [allow|deny]
+	Timeout string `json:"timeout,omitempty"`
+
+	// Unavailable overrides the unavailable decision of the policy, if not empty [allow|deny]
+	Unavailable string `json:"unavailable,omitempty"`
+}
+
+// ContainerListPolicy encapsulates policy for a container list of a pod spec
+type ContainerListPolicy struct {
+	// AllowedImages specifies image patterns admitted without signature verification,
+	// for example debug images for ephemeral containers. Patterns use path.Match syntax.
+	AllowedImages []string `json:"allowedImages,omitempty"`
+}
+
+// DefaultPolicy returns the policy used when no policy file is provided
+func DefaultPolicy() *Policy {
+	return &Policy{
+		UnknownKinds: policyDeny,
+		Timeout:      policyDeny,
+		Unavailable:  policyDeny,
+		MultiArch:    multiArchIndex,
+		Mode:         modeEnforce,
+	}
+}
+
+// LoadPolicy loads policy from a YAML file, using defaults for omitted values
+func LoadPolicy(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	policy := DefaultPolicy()
+	if err = yaml.Unmarshal(b, policy); err != nil {
+		return nil, errors.Annotatef(err, "unable to decode policy file %q", file)
+	}
+
+	if err = policy.validate(); err != nil {
+		return nil, errors.Annotatef(err, "invalid policy file %q", file)
+	}
+	return policy, nil
+}
+
+func (p *Policy) validate() error {
+	if err := validateDecision(p.UnknownKinds); err != nil {
+		return errors.Annotate(err, "unknownKinds")
+	}
+
+	if err := validateDecision(p.Timeout); err != nil {
+		return errors.Annotate(err, "timeout")
+	}
+
+	if err := validateDecision(p.Unavailable); err != nil {
+		return errors.Annotate(err, "unavailable")
+	}
+
+	switch p.MultiArch {
+	case multiArchIndex, multiArchPlatforms:
+	default:
+		return errors.Errorf("multiArch: invalid value %q, expected %q or %q", p.MultiArch, multiArchIndex, multiArchPlatforms)
+	}
+
+	if err := validateMode(p.Mode); err != nil {
+		return errors.Annotate(err, "mode")
+	}
+	for i, namespaceMode := range p.NamespaceModes {
+		if namespaceMode == nil || len(namespaceMode.Namespaces) == 0 {
+			return errors.Errorf("namespaceModes[%d]: namespaces are required", i)
+		}
+		for _, pattern := range namespaceMode.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Annotatef(err, "namespaceModes[%d]: namespaces: pattern %q", i, pattern)
+			}
+		}
+		if err := validateMode(namespaceMode.Mode); err != nil {
+			return errors.Annotatef(err, "namespaceModes[%d]: mode", i)
+		}
+	}
+
+	for i, failurePolicy := range p.FailurePolicies {
+		if err := failurePolicy.validate(); err != nil {
+			return errors.Annotatef(err, "failurePolicies[%d]", i)
+		}
+	}
+
+	for i, signerPolicy := range p.Signers {
+		if signerPolicy == nil || len(signerPolicy.Images) == 0 {
+			return errors.Errorf("signers[%d]: images are required", i)
+		}
+		for _, pattern := range signerPolicy.Images {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Annotatef(err, "signers[%d]: images: pattern %q", i, pattern)
+			}
+		}
+		if err := signerPolicy.Validate(); err != nil {
+			return errors.Annotatef(err, "signers[%d]", i)
+		}
+	}
+
+	if err := validateHashAlgorithms(p.HashAlgorithms); err != nil {
+		return errors.Annotate(err, "hashAlgorithms")
+	}
+	for i, hashPolicy := range p.HashPolicies {
+		if hashPolicy == nil || len(hashPolicy.Images) == 0 {
+			return errors.Errorf("hashPolicies[%d]: images are required", i)
+		}
+		if err := validatePatterns(hashPolicy.Images); err != nil {
+			return errors.Annotatef(err, "hashPolicies[%d]: images", i)
+		}
+		if len(hashPolicy.Algorithms) == 0 {
+			return errors.Errorf("hashPolicies[%d]: algorithms are required", i)
+		}
+		if err := validateHashAlgorithms(hashPolicy.Algorithms); err != nil {
+			return errors.Annotatef(err, "hashPolicies[%d]: algorithms", i)
+		}
+	}
+
+	for i, commitPolicy := range p.Commits {
+		if commitPolicy == nil || len(commitPolicy.Images) == 0 {
+			return errors.Errorf("commits[%d]: images are required", i)
+		}
+		if err := validatePatterns(commitPolicy.Images); err != nil {
+			return errors.Annotatef(err, "commits[%d]: images", i)
+		}
+		if err := validatePatterns(commitPolicy.Repos); err != nil {
+			return errors.Annotatef(err, "commits[%d]: repos", i)
+		}
+	}
+
+	for i, namespaceTeams := range p.NamespaceTeams {
+		if namespaceTeams == nil || len(namespaceTeams.Namespaces) == 0 {
+			return errors.Errorf("namespaceTeams[%d]: namespaces are required", i)
+		}
+		if err := validatePatterns(namespaceTeams.Namespaces); err != nil {
+			return errors.Annotatef(err, "namespaceTeams[%d]: namespaces", i)
+		}
+		if err := validatePatterns(namespaceTeams.Teams); err != nil {
+			return errors.Annotatef(err, "namespaceTeams[%d]: teams", i)
+		}
+	}
+
+	for i, namespaceRoles := range p.NamespaceRoles {
+		if namespaceRoles == nil || len(namespaceRoles.Namespaces) == 0 {
+			return errors.Errorf("namespaceRoles[%d]: namespaces are required", i)
+		}
+		if err := validatePatterns(namespaceRoles.Namespaces); err != nil {
+			return errors.Annotatef(err, "namespaceRoles[%d]: namespaces", i)
+		}
+		if err := validatePatterns(namespaceRoles.Requestors); err != nil {
+			return errors.Annotatef(err, "namespaceRoles[%d]: requestors", i)
+		}
+		if err := validatePatterns(namespaceRoles.Signers); err != nil {
+			return errors.Annotatef(err, "namespaceRoles[%d]: signers", i)
+		}
+	}
+
+	for name, listPolicy := range p.ContainerLists {
+		switch name {
+		case containersList, initContainersList, ephemeralContainersList:
+		default:
+			return errors.Errorf("containerLists: unknown container list %q", name)
+		}
+		if listPolicy == nil {
+			continue
+		}
+		for _, pattern := range listPolicy.AllowedImages {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Annotatef(err, "containerLists: %s: allowedImages: pattern %q", name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (fp *FailurePolicy) validate() error {
+	if fp == nil {
+		return errors.New("failure policy is empty")
+	}
+	for _, pattern := range append(append([]string{}, fp.Namespaces...), fp.Images...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Annotatef(err, "pattern %q", pattern)
+		}
+	}
+	if fp.Timeout != "" {
+		if err := validateDecision(fp.Timeout); err != nil {
+			return errors.Annotate(err, "timeout")
+		}
+	}
+	if fp.Unavailable != "" {
+		if err := validateDecision(fp.Unavailable); err != nil {
+			return errors.Annotate(err, "unavailable")
+		}
+	}
+	return nil
+}
+
+// signerPolicy returns the signer policy of the image, nil if any trusted certificate may sign it
+func (p *Policy) signerPolicy(image *imageReference) *validator.SignerPolicy {
+	name := image.Host + "/" + image.Repo
+	for _, signerPolicy := range p.Signers {
+		if matchesAny(signerPolicy.Images, name) {
+			return &signerPolicy.SignerPolicy
+		}
+	}
+	return nil
+}
+
+// hashAlgorithms returns hash algorithms allowed in signatures of the image, nil if any supported algorithm is allowed
+func (p *Policy) hashAlgorithms(image *imageReference) []string {
+	name := image.Host + "/" + image.Repo
+	for _, hashPolicy := range p.HashPolicies {
+		if matchesAny(hashPolicy.Images, name) {
+			return append([]string{}, hashPolicy.Algorithms...)
+		}
+	}
+	if len(p.HashAlgorithms) == 0 {
+		return nil
+	}
+	return append([]string{}, p.HashAlgorithms...)
+}
+
+// commitPolicy returns the commit policy of the image, nil if commits are not checked
+func (p *Policy) commitPolicy(image *imageReference) *CommitPolicy {
+	name := image.Host + "/" + image.Repo
+	for _, commitPolicy := range p.Commits {
+		if matchesAny(commitPolicy.Images, name) {
+			return commitPolicy
+		}
+	}
+	return nil
+}
+
+// namespaceTeams returns patterns of teams allowed in the namespace, nil if any team is allowed
+func (p *Policy) namespaceTeams(namespace string) []string {
+	for _, namespaceTeams := range p.NamespaceTeams {
+		if matchesAny(namespaceTeams.Namespaces, namespace) {
+			return append([]string{}, namespaceTeams.Teams...)
+		}
+	}
+	return nil
+}
+
+// namespaceRoles returns the roles allowed in the namespace, nil if any role is allowed
+func (p *Policy) namespaceRoles(namespace string) *NamespaceRoles {
+	for _, namespaceRoles := range p.NamespaceRoles {
+		if matchesAny(namespaceRoles.Namespaces, namespace) {
+			return namespaceRoles
+		}
+	}
+	return nil
+}
+
+// mode returns the enforcement mode of the namespace
+func (p *Policy) mode(namespace string) string {
+	for _, namespaceMode := range p.NamespaceModes {
+		if matchesAny(namespaceMode.Namespaces, namespace) {
+			return namespaceMode.Mode
+		}
+	}
+	return p.Mode
+}
+
+// failurePolicy returns the decisions for the image of the namespace that could not be verified,
+// from the first matching failure policy or else from the policy
+func (p *Policy) failurePolicy(namespace, image string) *FailurePolicy {
+	decisions := &FailurePolicy{
+		Timeout:     p.Timeout,
+		Unavailable: p.Unavailable,
+	}
+	for _, fp := range p.FailurePolicies {
+		if (len(fp.Namespaces) > 0 && !matchesAny(fp.Namespaces, namespace)) || (len(fp.Images) > 0 && !matchesAny(fp.Images, image)) {
+			continue
+		}
+		if fp.Timeout != "" {
+			decisions.Timeout = fp.Timeout
+		}
+		if fp.Unavailable != "" {
+			decisions.Unavailable = fp.Unavailable
+		}
+		break
+	}
+	return decisions
+}
+
+// containerListPolicy returns the policy for the container list, never nil
+func (p *Policy) containerListPolicy(name string) *ContainerListPolicy {
+	if listPolicy, ok := p.ContainerLists[name]; ok && listPolicy != nil {
+		return listPolicy
+	}
+	return &ContainerListPolicy{}
+}
+
+// allowsImage returns true if the image is admitted without signature verification
+func (lp *ContainerListPolicy) allowsImage(image string) bool {
+	return matchesAny(lp.AllowedImages, image)
+}
+
+// matchesAny returns true if the name matches any of path.Match patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Annotatef(err, "pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func validateHashAlgorithms(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if !validator.IsSupportedHashAlgorithm(algorithm) {
+			return errors.Errorf("invalid hash algorithm %q, expected %q, %q or %q", algorithm, validator.HashSHA256, validator.HashSHA384, validator.HashSHA512)
+		}
+	}
+	return nil
+}
+
+func validateDecision(decision string) error {
+	switch decision {
+	case policyAllow, policyDeny:
+		return nil
+	default:
+		return errors.Errorf("invalid decision %q, expected %q or %q", decision, policyAllow, policyDeny)
+	}
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case modeEnforce, modeAudit, modeWarn:
+		return nil
+	default:
+		return errors.Errorf("invalid mode %q, expected %q, %q or %q", mode, modeEnforce, modeAudit, modeWarn)
+	}
+}
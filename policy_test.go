@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicyFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "policy")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "policy.yml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func Test_LoadPolicy(t *testing.T) {
+	file := writePolicyFile(t, `
+containerLists:
+  ephemeralContainers:
+    allowedImages:
+    - "docker.io/library/busybox:*"
+`)
+	policy, err := LoadPolicy(file)
+	require.NoError(t, err)
+	assert.Equal(t, policyDeny, policy.UnknownKinds)
+
+	listPolicy := policy.containerListPolicy(ephemeralContainersList)
+	assert.True(t, listPolicy.allowsImage("docker.io/library/busybox:1.31"))
+	assert.False(t, listPolicy.allowsImage("docker.io/library/alpine:3.10"))
+	assert.False(t, policy.containerListPolicy(containersList).allowsImage("docker.io/library/busybox:1.31"))
+
+	file = writePolicyFile(t, "unknownKinds: ignore\n")
+	_, err = LoadPolicy(file)
+	require.Error(t, err)
+
+	file = writePolicyFile(t, "containerLists:\n  sidecars: {}\n")
+	_, err = LoadPolicy(file)
+	require.Error(t, err)
+}
+
+func Test_LoadPolicyMultiArch(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, "timeout: allow\n"))
+	require.NoError(t, err)
+	assert.Equal(t, multiArchIndex, policy.MultiArch)
+
+	policy, err = LoadPolicy(writePolicyFile(t, "multiArch: platforms\n"))
+	require.NoError(t, err)
+	assert.Equal(t, multiArchPlatforms, policy.MultiArch)
+
+	_, err = LoadPolicy(writePolicyFile(t, "multiArch: all\n"))
+	require.Error(t, err)
+
+	policy, err = LoadPolicy(writePolicyFile(t, "unavailable: allow\n"))
+	require.NoError(t, err)
+	assert.Equal(t, policyAllow, policy.Unavailable)
+
+	_, err = LoadPolicy(writePolicyFile(t, "unavailable: ignore\n"))
+	require.Error(t, err)
+}
+
+func Test_FailurePolicy(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+unavailable: deny
+failurePolicies:
+- namespaces:
+  - "dev-*"
+  unavailable: allow
+  timeout: allow
+- images:
+  - "registry/tools/*"
+  unavailable: allow
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, &FailurePolicy{Timeout: policyAllow, Unavailable: policyAllow}, policy.failurePolicy("dev-team", "registry/app:v1"))
+	assert.Equal(t, &FailurePolicy{Timeout: policyDeny, Unavailable: policyAllow}, policy.failurePolicy("prod", "registry/tools/jq:v1"))
+	assert.Equal(t, &FailurePolicy{Timeout: policyDeny, Unavailable: policyDeny}, policy.failurePolicy("prod", "registry/app:v1"))
+
+	_, err = LoadPolicy(writePolicyFile(t, "failurePolicies:\n- unavailable: ignore\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "failurePolicies:\n- images: [\"[\"]\n"))
+	require.Error(t, err)
+}
+
+func Test_PolicyMode(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+namespaceModes:
+- namespaces:
+  - "team-a"
+  - "sandbox-*"
+  mode: audit
+`))
+	require.NoError(t, err)
+	assert.Equal(t, modeAudit, policy.mode("team-a"))
+	assert.Equal(t, modeAudit, policy.mode("sandbox-1"))
+	assert.Equal(t, modeEnforce, policy.mode("team-b"))
+
+	_, err = LoadPolicy(writePolicyFile(t, "mode: dry-run\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "namespaceModes:\n- mode: audit\n"))
+	require.Error(t, err)
+}
+
+func Test_PolicySigners(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+signers:
+- images:
+  - "*.dkr.ecr.*.amazonaws.com/platform/*"
+  commonName: "platform-signer-.*"
+  emails:
+  - platform@example.com
+  issuers:
+  - platform-ca
+`))
+	require.NoError(t, err)
+
+	signerPolicy := policy.signerPolicy(parseImage("123456789012.dkr.ecr.us-east-2.amazonaws.com/platform/app:v1"))
+	require.NotNil(t, signerPolicy)
+	assert.Equal(t, "platform-signer-.*", signerPolicy.CommonName)
+	assert.Equal(t, []string{"platform@example.com"}, signerPolicy.Emails)
+	assert.Equal(t, []string{"platform-ca"}, signerPolicy.Issuers)
+	assert.Nil(t, policy.signerPolicy(parseImage("123456789012.dkr.ecr.us-east-2.amazonaws.com/team/app:v1")))
+
+	_, err = LoadPolicy(writePolicyFile(t, "signers:\n- commonName: signer\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "signers:\n- images: [\"registry/*\"]\n  commonName: \"(\"\n"))
+	require.Error(t, err)
+}
+
+func Test_PolicyCommits(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+commits:
+- images:
+  - "registry/platform/*"
+  requireApprover: true
+  requireDistinctApprover: true
+  repos:
+  - "github.com/org/platform-*"
+namespaceTeams:
+- namespaces:
+  - "platform-*"
+  teams:
+  - platform
+`))
+	require.NoError(t, err)
+
+	commitPolicy := policy.commitPolicy(parseImage("registry/platform/app:v1"))
+	require.NotNil(t, commitPolicy)
+	assert.True(t, commitPolicy.RequireApprover)
+	assert.True(t, commitPolicy.RequireDistinctApprover)
+	assert.Nil(t, policy.commitPolicy(parseImage("registry/team/app:v1")))
+	assert.Equal(t, []string{"platform"}, policy.namespaceTeams("platform-prod"))
+	assert.Nil(t, policy.namespaceTeams("team"))
+
+	_, err = LoadPolicy(writePolicyFile(t, "commits:\n- requireApprover: true\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "namespaceTeams:\n- teams: [platform]\n"))
+	require.Error(t, err)
+}
+
+func Test_PolicyRoles(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+namespaceRoles:
+- namespaces:
+  - "prod-*"
+  requestors:
+  - "ci-*"
+  signers:
+  - stampy-prod
+`))
+	require.NoError(t, err)
+
+	roles := policy.namespaceRoles("prod-app")
+	require.NotNil(t, roles)
+	assert.Equal(t, []string{"ci-*"}, roles.Requestors)
+	assert.Equal(t, []string{"stampy-prod"}, roles.Signers)
+	assert.Nil(t, policy.namespaceRoles("dev"))
+
+	_, err = LoadPolicy(writePolicyFile(t, "namespaceRoles:\n- signers: [stampy-prod]\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "namespaceRoles:\n- namespaces: [prod]\n  requestors: [\"[\"]\n"))
+	require.Error(t, err)
+}
+
+func Test_PolicyHashAlgorithms(t *testing.T) {
+	policy, err := LoadPolicy(writePolicyFile(t, `
+hashAlgorithms:
+- sha256
+- sha384
+- sha512
+hashPolicies:
+- images:
+  - "registry/secure/*"
+  algorithms:
+  - sha384
+  - sha512
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"sha384", "sha512"}, policy.hashAlgorithms(parseImage("registry/secure/app:v1")))
+	assert.Equal(t, []string{"sha256", "sha384", "sha512"}, policy.hashAlgorithms(parseImage("registry/team/app:v1")))
+	assert.Nil(t, DefaultPolicy().hashAlgorithms(parseImage("registry/team/app:v1")))
+
+	_, err = LoadPolicy(writePolicyFile(t, "hashAlgorithms: [sha1]\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "hashPolicies:\n- images: [\"registry/*\"]\n"))
+	require.Error(t, err)
+
+	_, err = LoadPolicy(writePolicyFile(t, "hashPolicies:\n- algorithms: [sha384]\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// digestHeader is the header with the manifest digest in registry responses
+	digestHeader = "Docker-Content-Digest"
+
+	// registryTimeout is the timeout of a registry request, unless the context deadline is sooner
+	registryTimeout = 10 * time.Second
+
+	// maxManifestSize limits manifests and referrers indexes read from registries,
+	// which accept manifests of up to 4 MiB
+	maxManifestSize = 4 << 20
+
+	// maxBlobSize limits blobs read from registries, which are only read for signatures
+	maxBlobSize = maxSignatureSize
+
+	// maxTokenSize limits token responses of token realms
+	maxTokenSize = 1 << 20
+)
+
+var (
+	// errRegistryUnavailable is the cause of errors of registries that cannot be reached,
+	// fail or throttle requests
+	errRegistryUnavailable = errors.New("registry unavailable")
+
+	// errBodyTooLarge is the cause of errors of responses larger than their limit
+	errBodyTooLarge = errors.New("response body too large")
+)
+
+// registryCredentials are credentials of a registry
+type registryCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"` // base64 encoded <username>:<password>
+}
+
+// credentialsProvider returns credentials of a registry, or nil for anonymous access
+type credentialsProvider func(context.Context) (*registryCredentials, error)
+
+// staticCredentials returns provider of the credentials
+func staticCredentials(credentials *registryCredentials) credentialsProvider {
+	return func(context.Context) (*registryCredentials, error) {
+		return credentials, nil
+	}
+}
+
+// registryClient fetches manifests and blobs with the Docker Registry v2 / OCI Distribution API,
+// authenticating with bearer tokens or basic auth as the registry challenges
+type registryClient struct {
+	host        string
+	baseURL     string
+	credentials credentialsProvider
+	tokenRealms []string // hosts of token realms trusted with the credentials, besides the registry host
+	client      *http.Client
+	logger      *logrus.Logger
+
+	lock           sync.Mutex
+	authorizations map[string]string // authorization headers by repository
+}
+
+// newRegistryClient returns client of the registry endpoint, [http://|https://]<host>. Credentials
+// are only sent to token realms of the registry host, or of the token realm hosts over https.
+func newRegistryClient(endpoint string, credentials credentialsProvider, tokenRealms []string, logger *logrus.Logger) (*registryClient, error) {
+	host, baseURL, err := parseRegistryEndpoint(endpoint)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &registryClient{
+		host:           host,
+		baseURL:        baseURL,
+		credentials:    credentials,
+		tokenRealms:    tokenRealms,
+		client:         &http.Client{Timeout: registryTimeout},
+		logger:         logger,
+		authorizations: make(map[string]string),
+	}, nil
+}
+
+// parseRegistryEndpoint returns host and base URL of the registry endpoint.
+// Endpoints without scheme use https.
+func parseRegistryEndpoint(endpoint string) (host, baseURL string, err error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return "", "", errors.Errorf("expected [http://|https://]<host>, got %q", endpoint)
+	}
+	return u.Host, u.Scheme + "://" + u.Host, nil
+}
+
+// loadRegistryCredentials loads credentials by registry host from a Docker config file
+func loadRegistryCredentials(file string) (map[string]*registryCredentials, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var config struct {
+		Auths map[string]*registryCredentials `json:"auths"`
+	}
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Annotatef(err, "file=%q", file)
+	}
+
+	for host, creds := range config.Auths {
+		if creds.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(creds.Auth)
+		if err != nil {
+			return nil, errors.Annotatef(err, "file=%q, host=%q", file, host)
+		}
+		s := strings.SplitN(string(decoded), ":", 2)
+		if len(s) != 2 {
+			return nil, errors.Errorf("api=loadRegistryCredentials, reason='expected <username>:<password> auth', file=%q, host=%q", file, host)
+		}
+		creds.Username, creds.Password = s[0], s[1]
+	}
+	return config.Auths, nil
+}
+
+// GetManifest returns manifest of the image by tag, or by digest for references by digest only.
+// Manifests whose digest does not match the digest reported by the registry are rejected.
+func (c *registryClient) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	resp, err := c.manifestRequest(ctx, http.MethodGet, image)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := readBody(resp.Body, maxManifestSize)
+	switch {
+	case err == errBodyTooLarge:
+		return "", errors.Annotatef(err, "api=GetManifest, image=%q, limit=%d", image, maxManifestSize)
+	case err != nil:
+		return "", errors.Annotatef(errRegistryUnavailable, "api=GetManifest, image=%q, err=%v", image, err)
+	}
+
+	manifest := string(b)
+	if err = checkReportedDigest(image, manifest, resp.Header.Get(digestHeader)); err != nil {
+		return "", errors.Trace(err)
+	}
+	return manifest, nil
+}
+
+// ResolveDigest returns the manifest digest of the image without fetching the manifest
+func (c *registryClient) ResolveDigest(ctx context.Context, image *imageReference) (string, error) {
+	resp, err := c.manifestRequest(ctx, http.MethodHead, image)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get(digestHeader)
+	if digest == "" {
+		return "", errors.Errorf("api=ResolveDigest, reason='no digest in response', image=%q", image)
+	}
+	return digest, nil
+}
+
+// manifestRequest sends the manifest request of the image
+func (c *registryClient) manifestRequest(ctx context.Context, method string, image *imageReference) (*http.Response, error) {
+	reference := image.Tag
+	if reference == "" {
+		reference = image.Digest
+	}
+
+	resp, err := c.request(ctx, method, image.Repo, "manifests/"+reference, strings.Join(manifestMediaTypes, ", "))
+	if err != nil {
+		return nil, errors.Annotatef(err, "image=%q", image)
+	}
+	return resp, nil
+}
+
+// GetReferrers returns descriptors of manifests that refer to the manifest with the digest
+// and have the artifact type. Registries without the referrers API return a not found error.
+func (c *registryClient) GetReferrers(ctx context.Context, repo, digest, artifactType string) ([]*manifestDescriptor, error) {
+	resp, err := c.request(ctx, http.MethodGet, repo, "referrers/"+digest+"?artifactType="+url.QueryEscape(artifactType), mediaTypeOCIIndex)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	var index manifestHeader
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+		return nil, errors.Annotatef(err, "api=GetReferrers, repo=%q, digest=%q", repo, digest)
+	}
+
+	// registries may ignore the artifact type filter
+	var referrers []*manifestDescriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.ArtifactType == artifactType {
+			referrers = append(referrers, descriptor)
+		}
+	}
+	return referrers, nil
+}
+
+// GetBlob returns the blob with the digest, not valid error for blobs that do not match the digest
+func (c *registryClient) GetBlob(ctx context.Context, repo, digest string) ([]byte, error) {
+	resp, err := c.request(ctx, http.MethodGet, repo, "blobs/"+digest, "*/*")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := readBody(resp.Body, maxBlobSize)
+	switch {
+	case err == errBodyTooLarge:
+		return nil, errors.Annotatef(err, "api=GetBlob, repo=%q, digest=%q, limit=%d", repo, digest, maxBlobSize)
+	case err != nil:
+		return nil, errors.Annotatef(errRegistryUnavailable, "api=GetBlob, repo=%q, digest=%q, err=%v", repo, digest, err)
+	}
+	if blobDigest, ok := validator.MatchDigest(digest, b); !ok {
+		return nil, errors.NewNotValid(nil, fmt.Sprintf("api=GetBlob, reason='blob digest mismatch', repo=%q, digest=%q, blob_digest=%q", repo, digest, blobDigest))
+	}
+	return b, nil
+}
+
+// request sends the request to /v2/<repo>/<resource>, authenticating as challenged by the registry.
+// Responses other than 200 OK are returned as errors, not found error for 404 Not Found, and
+// unauthorized or forbidden errors for 401 Unauthorized and 403 Forbidden.
+func (c *registryClient) request(ctx context.Context, method, repo, resource, accept string) (*http.Response, error) {
+	resourceURL := fmt.Sprintf("%s/v2/%s/%s", c.baseURL, repo, resource)
+
+	resp, err := c.do(ctx, method, resourceURL, accept, c.authorization(repo))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		authorization, err := c.authenticate(ctx, repo, challenge)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if resp, err = c.do(ctx, method, resourceURL, accept, authorization); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errors.NotFoundf("%s %s/%s", method, repo, resource)
+	case http.StatusUnauthorized:
+		resp.Body.Close()
+		return nil, errors.Unauthorizedf("api=request, method=%s, url=%q, status=%d", method, resourceURL, resp.StatusCode)
+	case http.StatusForbidden:
+		resp.Body.Close()
+		return nil, errors.Forbiddenf("api=request, method=%s, url=%q, status=%d", method, resourceURL, resp.StatusCode)
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		resp.Body.Close()
+		return nil, errors.Annotatef(errRegistryUnavailable, "api=request, method=%s, url=%q, status=%d", method, resourceURL, resp.StatusCode)
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("api=request, method=%s, url=%q, status=%d", method, resourceURL, resp.StatusCode)
+	}
+}
+
+func (c *registryClient) do(ctx context.Context, method, url, accept, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(errRegistryUnavailable, "api=do, method=%s, url=%q, err=%v", method, url, err)
+	}
+	return resp, nil
+}
+
+// authorization returns the authorization header of requests to the repository
+func (c *registryClient) authorization(repo string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.authorizations[repo]
+}
+
+// authenticate answers the WWW-Authenticate challenge and returns the authorization header,
+// which is reused for later requests to the repository
+func (c *registryClient) authenticate(ctx context.Context, repo, challenge string) (string, error) {
+	credentials, err := c.getCredentials(ctx)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var authorization string
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if credentials == nil {
+			return "", errors.Unauthorizedf("api=authenticate, reason='no credentials', host=%q", c.host)
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password))
+	case "bearer":
+		token, err := c.fetchToken(ctx, repo, params, credentials)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		authorization = "Bearer " + token
+	default:
+		return "", errors.Unauthorizedf("api=authenticate, reason='unsupported challenge', host=%q, challenge=%q", c.host, challenge)
+	}
+
+	c.lock.Lock()
+	c.authorizations[repo] = authorization
+	c.lock.Unlock()
+	return authorization, nil
+}
+
+// getCredentials returns credentials of the registry, nil for anonymous access
+func (c *registryClient) getCredentials(ctx context.Context) (*registryCredentials, error) {
+	if c.credentials == nil {
+		return nil, nil
+	}
+	credentials, err := c.credentials(ctx)
+	if err != nil {
+		return nil, errors.Annotatef(err, "api=getCredentials, host=%q", c.host)
+	}
+	return credentials, nil
+}
+
+// fetchToken fetches a bearer token with pull access to the repository from the realm of the challenge
+func (c *registryClient) fetchToken(ctx context.Context, repo string, params map[string]string, credentials *registryCredentials) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", errors.Errorf("api=fetchToken, reason='invalid realm', host=%q, realm=%q", c.host, params["realm"])
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repo)
+	}
+	query := realm.Query()
+	query.Set("scope", scope)
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	switch {
+	case credentials == nil:
+	case c.trustsRealm(realm):
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	default:
+		c.logger.Warnf("api=fetchToken, reason='untrusted realm, fetching an anonymous token', host=%q, realm=%q", c.host, params["realm"])
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Annotatef(errRegistryUnavailable, "api=fetchToken, host=%q, realm=%q, err=%v", c.host, params["realm"], err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", errors.Unauthorizedf("api=fetchToken, host=%q, realm=%q, status=%d", c.host, params["realm"], resp.StatusCode)
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return "", errors.Annotatef(errRegistryUnavailable, "api=fetchToken, host=%q, realm=%q, status=%d", c.host, params["realm"], resp.StatusCode)
+	default:
+		return "", errors.Errorf("api=fetchToken, host=%q, realm=%q, status=%d", c.host, params["realm"], resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxTokenSize)).Decode(&token); err != nil {
+		return "", errors.Trace(err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.Errorf("api=fetchToken, reason='empty token', host=%q, realm=%q", c.host, params["realm"])
+	}
+	return token.Token, nil
+}
+
+// trustsRealm returns true if the credentials may be sent to the token realm, which is on the
+// registry host or a token realm host and uses https, or has the scheme and host of the endpoint
+func (c *registryClient) trustsRealm(realm *url.URL) bool {
+	if realm.Scheme+"://"+realm.Host == c.baseURL {
+		return true
+	}
+	if realm.Scheme != "https" {
+		return false
+	}
+	if realm.Host == c.host {
+		return true
+	}
+	for _, host := range c.tokenRealms {
+		if realm.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the response body, errBodyTooLarge if it is larger than the limit
+func readBody(body io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return b, nil
+}
+
+// parseChallenge parses WWW-Authenticate header, <scheme> <key>="<value>",...
+// The scheme is returned in lower case.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	s := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	scheme := strings.ToLower(s[0])
+	if len(s) == 1 {
+		return scheme, params
+	}
+
+	rest := s[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = strings.TrimSpace(value)
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return scheme, params
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is an in-process registry serving manifests to clients with bearer tokens
+type testRegistry struct {
+	*httptest.Server
+
+	manifests map[string]string // manifests by <repo>:<tag> and <repo>@<digest>
+	username  string
+	password  string
+
+	lock     sync.Mutex
+	requests []string // <method> <path> of manifest requests
+}
+
+const testRegistryToken = "test-token"
+
+func newTestRegistry(t *testing.T, repo, tag, manifest string) *testRegistry {
+	r := &testRegistry{
+		manifests: map[string]string{
+			repo + ":" + tag: manifest,
+			repo + "@" + validator.SHA256Digest([]byte(manifest)): manifest,
+		},
+		username: "user",
+		password: "secret",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("service") != "test-registry" || req.URL.Query().Get("scope") != "repository:"+repo+":pull" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"token":%q}`, testRegistryToken)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		r.lock.Lock()
+		r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+		r.lock.Unlock()
+
+		if req.Header.Get("Authorization") != "Bearer "+testRegistryToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:%s:pull"`, r.URL, repo))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(req.Header.Get("Accept"), mediaTypeOCIIndex) {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+
+		s := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/", 2)
+		key := s[0] + ":" + s[1]
+		if strings.HasPrefix(s[1], "sha256:") {
+			key = s[0] + "@" + s[1]
+		}
+		manifest, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaTypeDockerManifest)
+		w.Header().Set(digestHeader, validator.SHA256Digest([]byte(manifest)))
+		if req.Method == http.MethodGet {
+			fmt.Fprint(w, manifest)
+		}
+	})
+
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func Test_registryClient(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	digest := validator.SHA256Digest([]byte(manifest))
+	registry := newTestRegistry(t, "team/app", "v1", manifest)
+	host := strings.TrimPrefix(registry.URL, "http://")
+	ctx := context.Background()
+
+	client, err := newRegistryClient(registry.URL, staticCredentials(&registryCredentials{Username: "user", Password: "secret"}), nil, logrus.New())
+	require.NoError(t, err)
+
+	t.Run("ByTag", func(t *testing.T) {
+		m, err := client.GetManifest(ctx, parseImage(host+"/team/app:v1"))
+		require.NoError(t, err)
+		assert.Equal(t, manifest, m)
+	})
+
+	t.Run("ByDigest", func(t *testing.T) {
+		m, err := client.GetManifest(ctx, parseImage(host+"/team/app@"+digest))
+		require.NoError(t, err)
+		assert.Equal(t, manifest, m)
+	})
+
+	t.Run("ResolveDigest", func(t *testing.T) {
+		resolved, err := client.ResolveDigest(ctx, parseImage(host+"/team/app:v1"))
+		require.NoError(t, err)
+		assert.Equal(t, digest, resolved)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := client.GetManifest(ctx, parseImage(host+"/team/app:v2"))
+		assert.True(t, errors.IsNotFound(errors.Cause(err)), "expected not found, got %v", err)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		anonymous, err := newRegistryClient(registry.URL, nil, nil, logrus.New())
+		require.NoError(t, err)
+		_, err = anonymous.GetManifest(ctx, parseImage(host+"/team/app:v1"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "api=fetchToken")
+	})
+
+	t.Run("DigestMismatch", func(t *testing.T) {
+		rewriting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(digestHeader, digest)
+			fmt.Fprint(w, `{"schemaVersion":2,"rewritten":true}`)
+		}))
+		defer rewriting.Close()
+
+		c, err := newRegistryClient(rewriting.URL, nil, nil, logrus.New())
+		require.NoError(t, err)
+		_, err = c.GetManifest(ctx, parseImage(host+"/team/app:v1"))
+		assert.Equal(t, errReportedDigestMismatch, errors.Cause(err))
+	})
+}
+
+func Test_cachingRegistryResolvesTags(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	registry := newTestRegistry(t, "app", "v1", manifest)
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	router, err := newRegistryRouter(&fakeImageController{}, RegistryConfig{Endpoints: []string{registry.URL}}, logrus.New())
+	require.NoError(t, err)
+	router.(*registryRouter).registries[host].credentials = staticCredentials(&registryCredentials{Username: "user", Password: "secret"})
+
+	// tags are not cached, so every lookup resolves the tag
+	c := newCachingImageController(router, CacheConfig{Size: 10, TTL: time.Hour})
+	for i := 0; i < 3; i++ {
+		m, err := c.GetManifest(context.Background(), parseImage(host+"/app:v1"))
+		require.NoError(t, err)
+		assert.Equal(t, manifest, m)
+	}
+
+	var gets int
+	for _, r := range registry.requests {
+		if strings.HasPrefix(r, http.MethodGet) {
+			gets++
+		}
+	}
+	assert.Equal(t, 1, gets)
+}
+
+func Test_fetchTokenRealms(t *testing.T) {
+	credentials := &registryCredentials{Username: "user", Password: "secret"}
+
+	var authenticated bool
+	realm := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _, authenticated = req.BasicAuth()
+		fmt.Fprintf(w, `{"token":%q}`, testRegistryToken)
+	}))
+	defer realm.Close()
+	realmHost := strings.TrimPrefix(realm.URL, "https://")
+
+	testCases := []struct {
+		name          string
+		realm         string
+		tokenRealms   []string
+		authenticated bool
+	}{
+		{name: "OtherHost", realm: realm.URL + "/token"},
+		{name: "TokenRealm", realm: realm.URL + "/token", tokenRealms: []string{realmHost}, authenticated: true},
+		{name: "TokenRealmOverHTTP", realm: "http://" + realmHost + "/token", tokenRealms: []string{realmHost}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := newRegistryClient("https://registry.example.com", staticCredentials(credentials), tc.tokenRealms, logrus.New())
+			require.NoError(t, err)
+			client.client = realm.Client()
+
+			authenticated = false
+			_, err = client.fetchToken(context.Background(), "app", map[string]string{"realm": tc.realm}, credentials)
+			if tc.authenticated {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.authenticated, authenticated)
+		})
+	}
+}
+
+func Test_trustsRealm(t *testing.T) {
+	testCases := []struct {
+		endpoint string
+		realm    string
+		trusted  bool
+	}{
+		{endpoint: "ghcr.io", realm: "https://ghcr.io/token", trusted: true},
+		{endpoint: "ghcr.io", realm: "http://ghcr.io/token"},
+		{endpoint: "ghcr.io", realm: "https://auth.docker.io/token", trusted: true},
+		{endpoint: "ghcr.io", realm: "http://auth.docker.io/token"},
+		{endpoint: "ghcr.io", realm: "https://attacker.example.com/token"},
+		{endpoint: "http://localhost:5000", realm: "http://localhost:5000/token", trusted: true},
+		{endpoint: "http://localhost:5000", realm: "http://localhost:5001/token"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.endpoint+" "+tc.realm, func(t *testing.T) {
+			client, err := newRegistryClient(tc.endpoint, nil, []string{"auth.docker.io"}, logrus.New())
+			require.NoError(t, err)
+			realm, err := url.Parse(tc.realm)
+			require.NoError(t, err)
+			assert.Equal(t, tc.trusted, client.trustsRealm(realm))
+		})
+	}
+}
+
+func Test_readBody(t *testing.T) {
+	b, err := readBody(strings.NewReader("signature"), 9)
+	require.NoError(t, err)
+	assert.Equal(t, "signature", string(b))
+
+	_, err = readBody(strings.NewReader("signature"), 8)
+	assert.Equal(t, errBodyTooLarge, err)
+}
+
+func Test_parseRegistryEndpoint(t *testing.T) {
+	testCases := []struct {
+		endpoint      string
+		host          string
+		baseURL       string
+		expectedError string
+	}{
+		{endpoint: "ghcr.io", host: "ghcr.io", baseURL: "https://ghcr.io"},
+		{endpoint: "http://localhost:5000", host: "localhost:5000", baseURL: "http://localhost:5000"},
+		{endpoint: "https://harbor.example.com/", host: "harbor.example.com", baseURL: "https://harbor.example.com"},
+		{endpoint: "https://harbor.example.com/v2", expectedError: `expected [http://|https://]<host>, got "https://harbor.example.com/v2"`},
+		{endpoint: "ftp://registry", expectedError: `expected [http://|https://]<host>, got "ftp://registry"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.endpoint, func(t *testing.T) {
+			host, baseURL, err := parseRegistryEndpoint(tc.endpoint)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.host, host)
+			assert.Equal(t, tc.baseURL, baseURL)
+		})
+	}
+}
+
+func Test_parseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:app:pull"`)
+	assert.Equal(t, "bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:app:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
+
+func Test_loadRegistryCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:s3cr:et"))
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"auths":{
+		"ghcr.io":{"auth":"`+auth+`"},
+		"harbor.example.com":{"username":"admin","password":"secret"}
+	}}`), 0600))
+
+	credentials, err := loadRegistryCredentials(file)
+	require.NoError(t, err)
+	assert.Equal(t, "robot", credentials["ghcr.io"].Username)
+	assert.Equal(t, "s3cr:et", credentials["ghcr.io"].Password)
+	assert.Equal(t, "admin", credentials["harbor.example.com"].Username)
+	assert.Equal(t, "secret", credentials["harbor.example.com"].Password)
+}
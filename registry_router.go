@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RegistryConfig specifies registries served with the Docker Registry v2 / OCI Distribution API
+type RegistryConfig struct {
+	// Endpoints specifies registries as [http://|https://]<host>
+	Endpoints []string
+
+	// AuthFile specifies Docker config file with credentials of the registries
+	AuthFile string
+
+	// TokenRealms specifies hosts of token realms, other than the registry hosts,
+	// that are sent registry credentials over https
+	TokenRealms []string
+}
+
+// digestResolver is implemented by image controllers that resolve image tags
+// to manifest digests without fetching manifests
+type digestResolver interface {
+	ResolveDigest(context.Context, *imageReference) (string, error)
+}
+
+// registryRouter fetches manifests of configured registry hosts with their registry clients,
+// and of other hosts with the ECR image controller, which also serves all signatures
+type registryRouter struct {
+	ImageControllerInterface
+
+	registries map[string]*registryClient // registry clients by host
+}
+
+// newRegistryRouter returns image controller that routes manifest requests by registry host
+func newRegistryRouter(imageManager ImageControllerInterface, config RegistryConfig, logger *logrus.Logger) (ImageControllerInterface, error) {
+	registries, err := newRegistryClients(config, logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &registryRouter{
+		ImageControllerInterface: imageManager,
+		registries:               registries,
+	}, nil
+}
+
+// newRegistryClients returns clients of the configured registries by host
+func newRegistryClients(config RegistryConfig, logger *logrus.Logger) (map[string]*registryClient, error) {
+	credentials := map[string]*registryCredentials{}
+	if config.AuthFile != "" {
+		var err error
+		if credentials, err = loadRegistryCredentials(config.AuthFile); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	registries := make(map[string]*registryClient)
+	for _, endpoint := range config.Endpoints {
+		host, _, err := parseRegistryEndpoint(endpoint)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if registries[host], err = newRegistryClient(endpoint, staticCredentials(credentials[host]), config.TokenRealms, logger); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return registries, nil
+}
+
+// GetManifest returns manifest of the image from its registry
+func (r *registryRouter) GetManifest(ctx context.Context, image *imageReference) (string, error) {
+	if client, ok := r.registries[image.Host]; ok {
+		return client.GetManifest(ctx, image)
+	}
+	return r.ImageControllerInterface.GetManifest(ctx, image)
+}
+
+// ResolveDigest returns manifest digest of the image, if its registry supports resolving digests
+func (r *registryRouter) ResolveDigest(ctx context.Context, image *imageReference) (string, error) {
+	if client, ok := r.registries[image.Host]; ok {
+		return client.ResolveDigest(ctx, image)
+	}
+	return "", errors.NotSupportedf("resolving digests of %q", image.Host)
+}
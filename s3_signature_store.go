@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultKeyTemplate is the key of signatures in S3 buckets, <repo>/<digest>/manifest.json.sig
+const defaultKeyTemplate = "{{.Repo}}/{{.Digest}}/manifest.json.sig"
+
+// S3Layout specifies buckets and keys of signatures in S3
+type S3Layout struct {
+	// KeyTemplate specifies the key of signatures as text/template with fields of signatureKey
+	KeyTemplate string `json:"keyTemplate"`
+
+	// Routes specifies locations of signatures of matching images, the first matching route is used
+	Routes []*S3Route `json:"routes,omitempty"`
+
+	// Default specifies location of signatures of images with no matching route.
+	// Its bucket and region default to -bucket and -region.
+	Default S3Route `json:"default"`
+}
+
+// S3Route specifies location of signatures of images
+type S3Route struct {
+	// Images specifies image patterns <host>/<repo> of the route. Patterns use path.Match syntax.
+	Images []string `json:"images,omitempty"`
+
+	// Bucket specifies the bucket, default route bucket if empty
+	Bucket string `json:"bucket,omitempty"`
+
+	// Region specifies region of the bucket, default route region if empty
+	Region string `json:"region,omitempty"`
+
+	// Prefix specifies prefix of the keys
+	Prefix string `json:"prefix,omitempty"`
+
+	// KeyTemplate overrides the key template of the layout
+	KeyTemplate string `json:"keyTemplate,omitempty"`
+
+	keyTemplate *template.Template
+}
+
+// signatureKey provides fields of key templates
+type signatureKey struct {
+	Host      string // registry host
+	Account   string // registry account of ECR hosts, empty for others
+	Region    string // registry region of ECR hosts, the configured region for others
+	Repo      string // repository
+	Digest    string // manifest digest, <algorithm>:<hex>
+	Algorithm string // digest algorithm, e.g. sha256
+	Hex       string // hex encoded digest
+}
+
+// DefaultS3Layout returns the layout used when no layout file is provided
+func DefaultS3Layout() *S3Layout {
+	return &S3Layout{
+		KeyTemplate: defaultKeyTemplate,
+	}
+}
+
+// LoadS3Layout loads S3 layout from a YAML file, using defaults for omitted values
+func LoadS3Layout(file string) (*S3Layout, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	layout := DefaultS3Layout()
+	if err = yaml.Unmarshal(b, layout); err != nil {
+		return nil, errors.Annotatef(err, "unable to decode S3 layout file %q", file)
+	}
+
+	if err = layout.validate(); err != nil {
+		return nil, errors.Annotatef(err, "invalid S3 layout file %q", file)
+	}
+	return layout, nil
+}
+
+func (l *S3Layout) validate() error {
+	if _, err := template.New("key").Parse(l.KeyTemplate); err != nil {
+		return errors.Annotate(err, "keyTemplate")
+	}
+	if len(l.Default.Images) > 0 {
+		return errors.New("default: images are not allowed")
+	}
+
+	for i, route := range l.Routes {
+		if route == nil || len(route.Images) == 0 {
+			return errors.Errorf("routes[%d]: images are required", i)
+		}
+		for _, pattern := range route.Images {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Annotatef(err, "routes[%d]: images: pattern %q", i, pattern)
+			}
+		}
+		if _, err := template.New("key").Parse(route.KeyTemplate); err != nil {
+			return errors.Annotatef(err, "routes[%d]: keyTemplate", i)
+		}
+	}
+	return nil
+}
+
+// s3SignatureStore provides signatures stored in S3 buckets routed by image
+type s3SignatureStore struct {
+	region string // region of images with no registry region
+	routes []*S3Route
+	route  *S3Route // default route
+	logger *logrus.Logger
+
+	lock     sync.Mutex
+	sessions map[string]*session.Session // sessions by region
+}
+
+// newS3SignatureStore returns S3 signature store of the layout. The default route uses
+// the bucket and region, unless the layout specifies them.
+func newS3SignatureStore(region, bucket string, layout *S3Layout, logger *logrus.Logger) (*s3SignatureStore, error) {
+	if layout == nil {
+		layout = DefaultS3Layout()
+	}
+	if err := layout.validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defaultRoute := layout.Default
+	if defaultRoute.Bucket == "" {
+		defaultRoute.Bucket = bucket
+	}
+	if defaultRoute.Region == "" {
+		defaultRoute.Region = region
+	}
+
+	s := &s3SignatureStore{
+		region:   region,
+		route:    layout.resolve(&defaultRoute, &defaultRoute),
+		logger:   logger,
+		sessions: make(map[string]*session.Session),
+	}
+	for _, route := range layout.Routes {
+		s.routes = append(s.routes, layout.resolve(route, &defaultRoute))
+	}
+	return s, nil
+}
+
+// resolve returns copy of the route with the bucket and region of the default route
+// when omitted, and with the parsed key template
+func (l *S3Layout) resolve(route, defaultRoute *S3Route) *S3Route {
+	r := *route
+	if r.Bucket == "" {
+		r.Bucket = defaultRoute.Bucket
+	}
+	if r.Region == "" {
+		r.Region = defaultRoute.Region
+	}
+
+	keyTemplate := r.KeyTemplate
+	if keyTemplate == "" {
+		keyTemplate = l.KeyTemplate
+	}
+	// templates are checked by validate
+	r.keyTemplate = template.Must(template.New("key").Parse(keyTemplate))
+	return &r
+}
+
+// location returns the route and the key of the manifest signature of the image
+func (s *s3SignatureStore) location(image *imageReference, digest string) (*S3Route, string, error) {
+	route := s.route
+	name := image.Host + "/" + image.Repo
+	for _, r := range s.routes {
+		if matchesAny(r.Images, name) {
+			route = r
+			break
+		}
+	}
+
+	key := signatureKey{
+		Host:   image.Host,
+		Region: s.region,
+		Repo:   image.Repo,
+		Digest: digest,
+	}
+	if account, region, ok := parseECRHost(image.Host); ok {
+		key.Account, key.Region = account, region
+	}
+	if s := strings.SplitN(digest, ":", 2); len(s) == 2 {
+		key.Algorithm, key.Hex = s[0], s[1]
+	}
+
+	var buf bytes.Buffer
+	if err := route.keyTemplate.Execute(&buf, key); err != nil {
+		return nil, "", errors.Annotatef(err, "api=location, image=%q", image)
+	}
+	return route, route.Prefix + buf.String(), nil
+}
+
+// GetManifestSignature returns manifest signature of the image
+func (s *s3SignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	route, manifestSigURL, err := s.location(image, digest)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	sess, err := s.createSession(route.Region)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	buf := aws.NewWriteAtBuffer([]byte{})
+	downloader := s3manager.NewDownloader(sess)
+	_, err = downloader.DownloadWithContext(ctx, buf,
+		&s3.GetObjectInput{
+			Bucket: aws.String(route.Bucket),
+			Key:    aws.String(manifestSigURL),
+		})
+	if err != nil {
+		return "", errors.Annotatef(s3Error(err), "api=GetManifestSignature, bucket=%q, manifestSigURL=%q, err=%v", route.Bucket, manifestSigURL, err)
+	}
+
+	return string(buf.Bytes()), nil
+}
+
+// s3Error returns the signature store error of the S3 error, or the error itself if it is
+// not known to be one of them. S3 reports missing keys as access denied to principals
+// without s3:ListBucket on the bucket. A missing bucket is a misconfigured store, not a
+// missing signature.
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return ErrBackendUnavailable
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case reqErr.StatusCode() == http.StatusNotFound:
+			return ErrSignatureNotFound
+		case reqErr.StatusCode() == http.StatusForbidden:
+			return ErrAccessDenied
+		case reqErr.StatusCode() >= http.StatusInternalServerError:
+			return ErrBackendUnavailable
+		}
+	}
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return ErrSignatureNotFound
+	case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoCredentialProviders":
+		return ErrAccessDenied
+	}
+	if request.IsErrorExpiredCreds(err) {
+		return ErrAccessDenied
+	}
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return ErrBackendUnavailable
+	}
+	return err
+}
+
+// createSession returns session of the region, creating it on first use
+func (s *s3SignatureStore) createSession(region string) (*session.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess, ok := s.sessions[region]; ok {
+		return sess, nil
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s.sessions[region] = sess
+	return sess, nil
+}
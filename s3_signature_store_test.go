@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadS3Layout(t *testing.T) {
+	layout, err := LoadS3Layout(writePolicyFile(t, `
+keyTemplate: "{{.Account}}/{{.Repo}}/{{.Algorithm}}/{{.Hex}}.sig"
+routes:
+- images:
+  - "*.dkr.ecr.*.amazonaws.com/platform/*"
+  bucket: platform-signatures
+  region: us-west-2
+  prefix: platform/
+- images:
+  - "ghcr.io/team/*"
+  keyTemplate: "ghcr/{{.Repo}}/{{.Digest}}/manifest.json.sig"
+default:
+  prefix: signatures/
+`))
+	require.NoError(t, err)
+	require.Len(t, layout.Routes, 2)
+
+	store, err := newS3SignatureStore("us-east-2", "docker-signatures", layout, logrus.New())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		image  string
+		bucket string
+		region string
+		key    string
+	}{
+		{
+			image:  "121924372514.dkr.ecr.us-east-1.amazonaws.com/platform/proxy:v1",
+			bucket: "platform-signatures",
+			region: "us-west-2",
+			key:    "platform/121924372514/platform/proxy/sha256/0123.sig",
+		},
+		{
+			image:  "ghcr.io/team/app:v1",
+			bucket: "docker-signatures",
+			region: "us-east-2",
+			key:    "ghcr/team/app/sha256:0123/manifest.json.sig",
+		},
+		{
+			image:  "121924372514.dkr.ecr.us-east-1.amazonaws.com/team/app:v1",
+			bucket: "docker-signatures",
+			region: "us-east-2",
+			key:    "signatures/121924372514/team/app/sha256/0123.sig",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.image, func(t *testing.T) {
+			route, key, err := store.location(parseImage(tc.image), "sha256:0123")
+			require.NoError(t, err)
+			assert.Equal(t, tc.bucket, route.Bucket)
+			assert.Equal(t, tc.region, route.Region)
+			assert.Equal(t, tc.key, key)
+		})
+	}
+
+	_, err = LoadS3Layout(writePolicyFile(t, "keyTemplate: \"{{.Repo\"\n"))
+	require.Error(t, err)
+
+	_, err = LoadS3Layout(writePolicyFile(t, "routes:\n- bucket: other\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "routes[0]: images are required")
+}
+
+func Test_DefaultS3Layout(t *testing.T) {
+	store, err := newS3SignatureStore("us-east-2", "docker-signatures", nil, logrus.New())
+	require.NoError(t, err)
+
+	route, key, err := store.location(parseImage("registry/team/app:v1"), "sha256:0123")
+	require.NoError(t, err)
+	assert.Equal(t, "docker-signatures", route.Bucket)
+	assert.Equal(t, "us-east-2", route.Region)
+	assert.Equal(t, signaturePath(parseImage("registry/team/app:v1"), "sha256:0123"), key)
+}
+
+func Test_s3Error(t *testing.T) {
+	other := errors.New("other")
+	// buckets in another region than the store are misconfigured, not unavailable
+	redirect := awserr.NewRequestFailure(awserr.New("PermanentRedirect", "wrong region", nil), http.StatusMovedPermanently, "id")
+	testCases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{name: "NoSuchKey", err: awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil), expected: ErrSignatureNotFound},
+		{name: "NotFound", err: awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), http.StatusNotFound, "id"), expected: ErrSignatureNotFound},
+		{name: "NoSuchBucket", err: awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchBucket, "no such bucket", nil), http.StatusNotFound, "id"), expected: ErrBackendUnavailable},
+		{name: "AccessDenied", err: awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), http.StatusForbidden, "id"), expected: ErrAccessDenied},
+		{name: "ExpiredToken", err: awserr.New("ExpiredToken", "expired", nil), expected: ErrAccessDenied},
+		{name: "SlowDown", err: awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, "id"), expected: ErrBackendUnavailable},
+		{name: "Throttling", err: awserr.New("Throttling", "throttled", nil), expected: ErrBackendUnavailable},
+		{name: "RequestError", err: awserr.New("RequestError", "send request failed", nil), expected: ErrBackendUnavailable},
+		{name: "PermanentRedirect", err: redirect, expected: redirect},
+		{name: "Other", err: other, expected: other},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, s3Error(tc.err))
+		})
+	}
+}
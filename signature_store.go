@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	signatureStoreS3  = "s3"
+	signatureStoreDir = "dir"
+	signatureStoreURL = "url"
+	signatureStoreOCI = "oci"
+
+	// signatureStoreTimeout is the timeout of a signature request, unless the context deadline is sooner
+	signatureStoreTimeout = 10 * time.Second
+
+	// maxSignatureSize limits signatures read from signature stores
+	maxSignatureSize = 1 << 20
+)
+
+// Errors of signature stores, returned as causes of GetManifestSignature errors
+var (
+	// ErrSignatureNotFound is returned when the store has no signature of the manifest
+	ErrSignatureNotFound = errors.New("signature not found")
+
+	// ErrBackendUnavailable is returned when the store cannot be reached, fails or throttles requests
+	ErrBackendUnavailable = errors.New("signature store unavailable")
+
+	// ErrAccessDenied is returned when the store refuses access to the signature
+	ErrAccessDenied = errors.New("access to signature denied")
+)
+
+// SignatureStore provides manifest signatures
+type SignatureStore interface {
+	// GetManifestSignature returns signature of the image manifest with the digest.
+	// Errors have ErrSignatureNotFound, ErrBackendUnavailable or ErrAccessDenied as their cause
+	// when the failure is known to be one of them.
+	GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error)
+}
+
+// multiSignatureStore is implemented by signature stores that may hold several signatures of a manifest,
+// such as registries with several signature artifacts referring to it
+type multiSignatureStore interface {
+	// GetManifestSignatures returns signatures of the image manifest with the digest,
+	// with the errors of GetManifestSignature
+	GetManifestSignatures(ctx context.Context, image *imageReference, digest string) ([]string, error)
+}
+
+// getManifestSignatures returns signatures of the image manifest with the digest in the store,
+// none if the store returns an empty signature
+func getManifestSignatures(ctx context.Context, store SignatureStore, image *imageReference, digest string) ([]string, error) {
+	if multiStore, ok := store.(multiSignatureStore); ok {
+		return multiStore.GetManifestSignatures(ctx, image, digest)
+	}
+
+	sig, err := store.GetManifestSignature(ctx, image, digest)
+	if err != nil || sig == "" {
+		return nil, err
+	}
+	return []string{sig}, nil
+}
+
+// signaturePath returns location of the manifest signature relative to the store root
+func signaturePath(image *imageReference, digest string) string {
+	return fmt.Sprintf("%s/%s/manifest.json.sig", image.Repo, digest)
+}
+
+// parseSignatureStore parses signature store specification s3[:<bucket>], dir:<path>, url:<base URL> or oci
+func parseSignatureStore(spec string) (kind, location string, err error) {
+	s := strings.SplitN(spec, ":", 2)
+	kind = s[0]
+	if len(s) > 1 {
+		location = s[1]
+	}
+
+	switch kind {
+	case signatureStoreS3:
+		return kind, location, nil
+	case signatureStoreDir:
+		if location == "" {
+			return "", "", errors.Errorf("expected dir:<path>, got %q", spec)
+		}
+		return kind, location, nil
+	case signatureStoreURL:
+		if u, err := url.Parse(location); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return "", "", errors.Errorf("expected url:<http|https>://<host>[/<path>], got %q", spec)
+		}
+		return kind, location, nil
+	case signatureStoreOCI:
+		if location != "" {
+			return "", "", errors.Errorf("expected oci, got %q", spec)
+		}
+		return kind, location, nil
+	default:
+		return "", "", errors.Errorf("unsupported signature store %q", kind)
+	}
+}
+
+// NewSignatureStore creates signature store from its specification. S3 stores use the bucket
+// of the specification, or the default bucket, in the region, as routed by the layout.
+// OCI stores read signatures from the registries, or from ECR registries.
+func NewSignatureStore(spec, region, bucket string, layout *S3Layout, registries RegistryConfig, logger *logrus.Logger) (SignatureStore, error) {
+	kind, location, err := parseSignatureStore(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch kind {
+	case signatureStoreDir:
+		return newDirSignatureStore(location), nil
+	case signatureStoreURL:
+		return newURLSignatureStore(location), nil
+	case signatureStoreOCI:
+		store, err := newOCISignatureStore(region, registries, logger)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return store, nil
+	default:
+		if location != "" {
+			bucket = location
+		}
+		store, err := newS3SignatureStore(region, bucket, layout, logger)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return store, nil
+	}
+}
+
+// dirSignatureStore provides signatures stored in a local directory as <repo>/<digest>/manifest.json.sig,
+// for example for air-gapped clusters
+type dirSignatureStore struct {
+	dir string
+}
+
+func newDirSignatureStore(dir string) *dirSignatureStore {
+	return &dirSignatureStore{dir: dir}
+}
+
+// GetManifestSignature returns manifest signature of the image
+func (s *dirSignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	// repositories and digests come from admitted objects and must not escape the directory
+	sigPath := path.Clean("/" + signaturePath(image, digest))
+	if sigPath != "/"+signaturePath(image, digest) {
+		return "", errors.Annotatef(ErrSignatureNotFound, "api=GetManifestSignature, reason='invalid signature path', image=%q, digest=%q", image, digest)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(sigPath)))
+	if os.IsNotExist(err) {
+		return "", errors.Annotatef(ErrSignatureNotFound, "api=GetManifestSignature, image=%q, digest=%q", image, digest)
+	}
+	if os.IsPermission(err) {
+		return "", errors.Annotatef(ErrAccessDenied, "api=GetManifestSignature, image=%q, digest=%q, err=%v", image, digest, err)
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(b), nil
+}
+
+// urlSignatureStore provides signatures served over HTTP(S) as <base URL>/<repo>/<digest>/manifest.json.sig
+type urlSignatureStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newURLSignatureStore(baseURL string) *urlSignatureStore {
+	return &urlSignatureStore{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: signatureStoreTimeout},
+	}
+}
+
+// GetManifestSignature returns manifest signature of the image
+func (s *urlSignatureStore) GetManifestSignature(ctx context.Context, image *imageReference, digest string) (string, error) {
+	sigURL := s.baseURL + "/" + signaturePath(image, digest)
+	req, err := http.NewRequest(http.MethodGet, sigURL, nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Annotatef(ErrBackendUnavailable, "api=GetManifestSignature, url=%q, err=%v", sigURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errors.Annotatef(ErrSignatureNotFound, "api=GetManifestSignature, url=%q", sigURL)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", errors.Annotatef(ErrAccessDenied, "api=GetManifestSignature, url=%q, status=%d", sigURL, resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return "", errors.Annotatef(ErrBackendUnavailable, "api=GetManifestSignature, url=%q, status=%d", sigURL, resp.StatusCode)
+	default:
+		return "", errors.Errorf("api=GetManifestSignature, url=%q, status=%d", sigURL, resp.StatusCode)
+	}
+
+	b, err := readBody(resp.Body, maxSignatureSize)
+	switch {
+	case err == errBodyTooLarge:
+		return "", errors.Annotatef(err, "api=GetManifestSignature, url=%q, limit=%d", sigURL, maxSignatureSize)
+	case err != nil:
+		return "", errors.Annotatef(ErrBackendUnavailable, "api=GetManifestSignature, url=%q, err=%v", sigURL, err)
+	}
+	return string(b), nil
+}
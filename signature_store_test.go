@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSignatureStore(t *testing.T) {
+	testCases := []struct {
+		spec          string
+		kind          string
+		location      string
+		expectedError string
+	}{
+		{spec: "s3", kind: signatureStoreS3},
+		{spec: "s3:docker-signatures", kind: signatureStoreS3, location: "docker-signatures"},
+		{spec: "dir:/var/lib/stampy", kind: signatureStoreDir, location: "/var/lib/stampy"},
+		{spec: "url:https://signatures.example.com/stampy", kind: signatureStoreURL, location: "https://signatures.example.com/stampy"},
+		{spec: "dir:", expectedError: `expected dir:<path>, got "dir:"`},
+		{spec: "url:signatures.example.com", expectedError: `expected url:<http|https>://<host>[/<path>], got "url:signatures.example.com"`},
+		{spec: "oci", kind: signatureStoreOCI},
+		{spec: "oci:registry", expectedError: `expected oci, got "oci:registry"`},
+		{spec: "gcs:signatures", expectedError: `unsupported signature store "gcs"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			kind, location, err := parseSignatureStore(tc.spec)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.kind, kind)
+			assert.Equal(t, tc.location, location)
+		})
+	}
+
+	store, err := NewSignatureStore("s3:other-bucket", "us-east-2", "docker-signatures", nil, RegistryConfig{}, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, "other-bucket", store.(*s3SignatureStore).route.Bucket)
+}
+
+func Test_dirSignatureStore(t *testing.T) {
+	dir := t.TempDir()
+	digest := "sha256:0123"
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "team", "app", digest), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "team", "app", digest, "manifest.json.sig"), []byte("signature"), 0600))
+
+	store := newDirSignatureStore(dir)
+	ctx := context.Background()
+
+	sig, err := store.GetManifestSignature(ctx, parseImage("registry/team/app:v1"), digest)
+	require.NoError(t, err)
+	assert.Equal(t, "signature", sig)
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/team/other:v1"), digest)
+	assert.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/../../etc:v1"), digest)
+	assert.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+	assert.Contains(t, err.Error(), "invalid signature path")
+}
+
+func Test_urlSignatureStore(t *testing.T) {
+	digest := "sha256:0123"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stampy/team/app/" + digest + "/manifest.json.sig":
+			w.Write([]byte("signature"))
+		case "/stampy/team/broken/" + digest + "/manifest.json.sig":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/stampy/team/private/" + digest + "/manifest.json.sig":
+			w.WriteHeader(http.StatusForbidden)
+		case "/stampy/team/large/" + digest + "/manifest.json.sig":
+			w.Write(make([]byte, maxSignatureSize+1))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	store := newURLSignatureStore(srv.URL + "/stampy/")
+	ctx := context.Background()
+
+	sig, err := store.GetManifestSignature(ctx, parseImage("registry/team/app:v1"), digest)
+	require.NoError(t, err)
+	assert.Equal(t, "signature", sig)
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/team/other:v1"), digest)
+	assert.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/team/broken:v1"), digest)
+	assert.Equal(t, ErrBackendUnavailable, errors.Cause(err))
+	assert.Contains(t, err.Error(), "status=500")
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/team/private:v1"), digest)
+	assert.Equal(t, ErrAccessDenied, errors.Cause(err))
+
+	_, err = store.GetManifestSignature(ctx, parseImage("registry/team/large:v1"), digest)
+	assert.Equal(t, errBodyTooLarge, errors.Cause(err))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/go-phorce/dolly/xpki/certutil"
+	"github.com/juju/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	trustStoreFile      = "file"
+	trustStoreDir       = "dir"
+	trustStoreConfigMap = "configmap"
+
+	// trustStoreRefresh specifies how often trust anchors are reloaded
+	trustStoreRefresh = time.Minute
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// parseTrustStore parses trust store specification <file|dir|configmap>:<location>,
+// where location of a configmap is <namespace>/<name>
+func parseTrustStore(spec string) (kind, location string, err error) {
+	s := strings.SplitN(spec, ":", 2)
+	if len(s) != 2 || s[1] == "" {
+		return "", "", errors.Errorf("expected <file|dir|configmap>:<location>, got %q", spec)
+	}
+
+	kind, location = s[0], s[1]
+	switch kind {
+	case trustStoreFile, trustStoreDir:
+	case trustStoreConfigMap:
+		if s := strings.Split(location, "/"); len(s) != 2 || s[0] == "" || s[1] == "" {
+			return "", "", errors.Errorf("expected configmap:<namespace>/<name>, got %q", spec)
+		}
+	default:
+		return "", "", errors.Errorf("unsupported trust store %q", kind)
+	}
+	return kind, location, nil
+}
+
+// NewTrustStore creates trust store from its specification
+func NewTrustStore(spec string) (validator.TrustStore, error) {
+	kind, location, err := parseTrustStore(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var load validator.CertsLoader
+	switch kind {
+	case trustStoreFile:
+		load = validator.LoadCertsFromFile(location)
+	case trustStoreDir:
+		load = validator.LoadCertsFromDir(location)
+	case trustStoreConfigMap:
+		s := strings.Split(location, "/")
+		if load, err = loadCertsFromConfigMap(s[0], s[1]); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	trustStore := validator.NewTrustStore(load, trustStoreRefresh)
+	if _, err = trustStore.Roots(); err != nil {
+		return nil, errors.Annotatef(err, "trustStore=%q", spec)
+	}
+	return trustStore, nil
+}
+
+// NewKeyring creates keyring of OpenPGP public keys from the file, nil if no file is specified
+func NewKeyring(file string) (validator.Keyring, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	keyring := validator.NewKeyring(validator.LoadKeysFromFile(file), trustStoreRefresh)
+	if _, err := keyring.Keys(); err != nil {
+		return nil, errors.Annotatef(err, "keyring=%q", file)
+	}
+	return keyring, nil
+}
+
+// loadCertsFromConfigMap returns a loader of PEM encoded certificates from every
+// value of the ConfigMap, read from the Kubernetes API with the pod's service account
+func loadCertsFromConfigMap(namespace, name string) (validator.CertsLoader, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("api=loadCertsFromConfigMap, reason='not running in a Kubernetes cluster'")
+	}
+
+	caPEM, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Annotate(err, "api=loadCertsFromConfigMap, reason='unable to read service account CA'")
+	}
+
+	caPool, err := certutil.CreatePoolFromPEM(caPEM)
+	if err != nil {
+		return nil, errors.Annotate(err, "api=loadCertsFromConfigMap, reason='unable to load service account CA'")
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: caPool},
+		},
+	}
+	url := fmt.Sprintf("https://%s/api/v1/namespaces/%s/configmaps/%s", net.JoinHostPort(host, port), namespace, name)
+	return configMapCertsLoader(client, url, path.Join(serviceAccountDir, "token")), nil
+}
+
+// configMapCertsLoader returns a loader of PEM encoded certificates from every value of the ConfigMap
+// at the URL, in the order of their keys, authenticated with the bearer token of the file
+func configMapCertsLoader(client *http.Client, url, tokenFile string) validator.CertsLoader {
+	return func(ctx context.Context) ([]*x509.Certificate, error) {
+		// the token is rotated by the kubelet, read it on every request
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("api=loadCertsFromConfigMap, url=%q, status=%d", url, resp.StatusCode)
+		}
+
+		var configMap corev1.ConfigMap
+		if err = json.NewDecoder(resp.Body).Decode(&configMap); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var certs []*x509.Certificate
+		for _, key := range keys {
+			chain, err := certutil.ParseChainFromPEM([]byte(configMap.Data[key]))
+			if err != nil {
+				return nil, errors.Annotatef(err, "url=%q, key=%q", url, key)
+			}
+			certs = append(certs, chain...)
+		}
+		return certs, nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.soma.salesforce.com/stampy-webhook-admission-controller-aws/validator"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newTestRootPEM returns PEM encoded self-signed root certificate with the common name
+func newTestRootPEM(t *testing.T, cn string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func Test_configMapCertsLoader(t *testing.T) {
+	configMap := &corev1.ConfigMap{Data: map[string]string{
+		"a.pem": newTestRootPEM(t, "a"),
+		"b.pem": newTestRootPEM(t, "b"),
+		"c.pem": newTestRootPEM(t, "c"),
+		"d.pem": newTestRootPEM(t, "d"),
+	}}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(configMap)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token\n"), 0600))
+
+	load := configMapCertsLoader(srv.Client(), srv.URL+"/api/v1/namespaces/stampy/configmaps/trust-anchors", tokenFile)
+	trustStore := validator.NewTrustStore(load, 0)
+	roots, err := trustStore.Roots()
+	require.NoError(t, err)
+	require.Len(t, roots.Subjects(), 4)
+
+	// reloading the same ConfigMap keeps the generation of the roots
+	generation := trustStore.(validator.Reloading).Generation()
+	for i := 0; i < 10; i++ {
+		require.Equal(t, generation, trustStore.(validator.Reloading).Generation())
+	}
+
+	configMap.Data["e.pem"] = newTestRootPEM(t, "e")
+	require.Equal(t, generation+1, trustStore.(validator.Reloading).Generation())
+}
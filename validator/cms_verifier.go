@@ -0,0 +1,71 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/base64"
+
+	"git.soma.salesforce.com/kuleana/go-pkg/cms"
+	"github.com/juju/errors"
+)
+
+func init() {
+	RegisterFormatVerifier("cms-detached", FormatVerifierFunc(verifyDetached))
+	RegisterFormatVerifier("pkcs7-detached", FormatVerifierFunc(verifyDetached))
+	RegisterFormatVerifier("cms", FormatVerifierFunc(verifyEmbedded))
+	RegisterFormatVerifier("pkcs7", FormatVerifierFunc(verifyEmbedded))
+}
+
+// verifyDetached verifies detached CMS signature of the manifest
+func verifyDetached(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error {
+	signer, sd, err := verifyCMSSigner(artifact, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err = sd.VerifyDetached(manifest, signer.verifyOptions, signer.signer); err != nil {
+		return errors.Annotatef(ErrInvalidSignature, "reason=verifyDetached, artifact=%q, sig_id=%s, err=%v", artifact.Name, artifact.SigID, err)
+	}
+	return nil
+}
+
+// verifyEmbedded verifies CMS signature with the embedded manifest
+func verifyEmbedded(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error {
+	signer, sd, err := verifyCMSSigner(artifact, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	content, err := sd.GetData()
+	if err != nil || !bytes.Equal(content, manifest) {
+		return errors.Annotatef(ErrInvalidSignature, "reason='embedded content does not match the manifest', artifact=%q, sig_id=%s", artifact.Name, artifact.SigID)
+	}
+
+	if _, err = sd.Verify(signer.verifyOptions, signer.signer); err != nil {
+		return errors.Annotatef(ErrInvalidSignature, "reason=verifyEmbedded, artifact=%q, sig_id=%s, err=%v", artifact.Name, artifact.SigID, err)
+	}
+	return nil
+}
+
+// verifyCMSSigner verifies the signer certificate of the artifact against the trust store
+// and the signer policy, and returns it with the parsed signed data
+func verifyCMSSigner(artifact *SignatureInfo, opts *VerifyOptions) (*signerOptions, *cms.SignedData, error) {
+	signer, err := verifySigner(artifact, opts.TrustStore)
+	if err != nil {
+		return nil, nil, errors.Annotatef(ErrUntrustedSigner, "certificate=%q, err=%v", artifact.Certificate, err)
+	}
+
+	if err = opts.SignerPolicy.verify(signer.signer, signer.chains); err != nil {
+		return nil, nil, errors.Annotatef(ErrSignerNotAllowed, "subject=%q, err=%v", signer.signer.Subject, err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(artifact.Signature)
+	if err != nil {
+		return nil, nil, errors.Annotatef(ErrInvalidSignature, "reason='unable to decode signature', err=%v", err)
+	}
+
+	sd, err := cms.ParseSignedData(der)
+	if err != nil {
+		return nil, nil, errors.Annotatef(ErrInvalidSignature, "reason='unable to parse signed data', err=%v", err)
+	}
+	return signer, sd, nil
+}
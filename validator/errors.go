@@ -0,0 +1,20 @@
+package validator
+
+import "github.com/juju/errors"
+
+var (
+	// ErrSignatureNotFound is returned when the signature response has no signature for the manifest
+	ErrSignatureNotFound = errors.New("signature not found")
+
+	// ErrHashNotAllowed is returned when the signature of the manifest uses a hash algorithm that is not allowed
+	ErrHashNotAllowed = errors.New("hash algorithm is not allowed")
+
+	// ErrUntrustedSigner is returned when the signing certificate does not chain to the trust store
+	ErrUntrustedSigner = errors.New("signing certificate is not trusted")
+
+	// ErrSignerNotAllowed is returned when the trusted signing certificate is not allowed by the signer policy
+	ErrSignerNotAllowed = errors.New("signing certificate is not allowed")
+
+	// ErrInvalidSignature is returned when the signature is malformed or does not match the manifest
+	ErrInvalidSignature = errors.New("invalid signature")
+)
@@ -0,0 +1,59 @@
+package validator
+
+import "sync"
+
+// VerifyOptions specifies trust anchors and policy that signatures are verified with
+type VerifyOptions struct {
+	// TrustStore provides the roots of X.509 signing certificates
+	TrustStore TrustStore
+
+	// Keyring provides the OpenPGP public keys of gpg signatures, optional
+	Keyring Keyring
+
+	// SignerPolicy constrains signers in addition to the trust anchors, optional
+	SignerPolicy *SignerPolicy
+
+	// HashAlgorithms specifies hash algorithms allowed to hash the manifest [sha256|sha384|sha512],
+	// any of them if empty
+	HashAlgorithms []string
+}
+
+// FormatVerifier verifies signatures of a signature format
+type FormatVerifier interface {
+	// Verify verifies the signature of the artifact over the manifest. Returned errors
+	// are caused by ErrUntrustedSigner, ErrSignerNotAllowed or ErrInvalidSignature.
+	Verify(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error
+}
+
+// FormatVerifierFunc is an adapter to use functions as format verifiers
+type FormatVerifierFunc func(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error
+
+// Verify calls f(manifest, artifact, opts)
+func (f FormatVerifierFunc) Verify(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error {
+	return f(manifest, artifact, opts)
+}
+
+var (
+	formatVerifiersLock sync.RWMutex
+	formatVerifiers     = map[string]FormatVerifier{}
+)
+
+// RegisterFormatVerifier registers the verifier of signatures of the format,
+// replacing the verifier previously registered for the format. Nil verifier
+// unregisters the format.
+func RegisterFormatVerifier(format string, verifier FormatVerifier) {
+	formatVerifiersLock.Lock()
+	defer formatVerifiersLock.Unlock()
+	if verifier == nil {
+		delete(formatVerifiers, format)
+		return
+	}
+	formatVerifiers[format] = verifier
+}
+
+// formatVerifier returns the verifier registered for the format, nil if the format is not supported
+func formatVerifier(format string) FormatVerifier {
+	formatVerifiersLock.RLock()
+	defer formatVerifiersLock.RUnlock()
+	return formatVerifiers[format]
+}
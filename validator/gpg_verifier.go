@@ -0,0 +1,50 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+func init() {
+	RegisterFormatVerifier("gpg", FormatVerifierFunc(verifyGPG))
+}
+
+// verifyGPG verifies detached OpenPGP signature of the manifest, ASCII armored or base64 encoded,
+// with the keys of the keyring. The public key carried in the signature is not trusted.
+// Signer policies may only constrain emails of the key's identities.
+func verifyGPG(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error {
+	if opts.Keyring == nil {
+		return errors.Annotate(ErrUntrustedSigner, "reason='no keyring'")
+	}
+	keys, err := opts.Keyring.Keys()
+	if err != nil {
+		return errors.Annotatef(ErrUntrustedSigner, "reason=Keys, err=%v", err)
+	}
+
+	var signer *openpgp.Entity
+	if strings.HasPrefix(strings.TrimSpace(artifact.Signature), "-----BEGIN") {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(manifest), strings.NewReader(artifact.Signature))
+	} else {
+		var sig []byte
+		if sig, err = base64.StdEncoding.DecodeString(artifact.Signature); err != nil {
+			return errors.Annotatef(ErrInvalidSignature, "reason='unable to decode signature', err=%v", err)
+		}
+		signer, err = openpgp.CheckDetachedSignature(keys, bytes.NewReader(manifest), bytes.NewReader(sig))
+	}
+	if err == pgperrors.ErrUnknownIssuer {
+		return errors.Annotatef(ErrUntrustedSigner, "reason='key is not in the keyring', sig_id=%s", artifact.SigID)
+	}
+	if err != nil {
+		return errors.Annotatef(ErrInvalidSignature, "reason=verifyGPG, artifact=%q, sig_id=%s, err=%v", artifact.Name, artifact.SigID, err)
+	}
+
+	if err = opts.SignerPolicy.verifyOpenPGP(signer); err != nil {
+		return errors.Annotatef(ErrSignerNotAllowed, "key=%s, err=%v", signer.PrimaryKey.KeyIdString(), err)
+	}
+	return nil
+}
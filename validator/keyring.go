@@ -0,0 +1,85 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Keyring provides the OpenPGP public keys that gpg signatures must be made with
+type Keyring interface {
+	// Keys returns the trusted public keys
+	Keys() (openpgp.EntityList, error)
+}
+
+// KeysLoader loads trusted OpenPGP public keys from a source
+type KeysLoader func(ctx context.Context) (openpgp.EntityList, error)
+
+// reloadingKeyring implements Keyring by loading keys from a source
+// and reloading them once the refresh period has passed
+type reloadingKeyring struct {
+	*reloader
+}
+
+// NewKeyring returns a keyring that loads keys with the loader,
+// and reloads them after the refresh period
+func NewKeyring(load KeysLoader, refresh time.Duration) Keyring {
+	return &reloadingKeyring{newReloader(func(ctx context.Context) (interface{}, []byte, error) {
+		keys, err := load(ctx)
+		if err == nil && len(keys) == 0 {
+			err = errors.New("no public keys found")
+		}
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		return keys, keysFingerprint(keys), nil
+	}, refresh)}
+}
+
+// Keys returns the trusted public keys. If reloading fails,
+// previously loaded keys are returned.
+func (k *reloadingKeyring) Keys() (openpgp.EntityList, error) {
+	keys, _, err := k.get()
+	if err != nil {
+		return nil, errors.Annotate(err, "api=Keys, reason=load")
+	}
+	return keys.(openpgp.EntityList), nil
+}
+
+// keysFingerprint returns the hash of the public key packets of the keys
+func keysFingerprint(keys openpgp.EntityList) []byte {
+	h := sha256.New()
+	for _, key := range keys {
+		if err := key.Serialize(h); err != nil {
+			// keys that cannot be serialized are told apart by their fingerprint
+			h.Write(key.PrimaryKey.Fingerprint[:])
+		}
+	}
+	return h.Sum(nil)
+}
+
+// LoadKeysFromFile returns a loader of ASCII armored or binary OpenPGP public keys from the file
+func LoadKeysFromFile(file string) KeysLoader {
+	return func(context.Context) (openpgp.EntityList, error) {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		var keys openpgp.EntityList
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+			keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		} else {
+			keys, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		}
+		if err != nil {
+			return nil, errors.Annotatef(err, "file=%q", file)
+		}
+		return keys, nil
+	}
+}
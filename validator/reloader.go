@@ -0,0 +1,85 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// loadTimeout bounds loading of trust anchors, so admissions waiting on a reload are not held
+// longer than that by an unresponsive source
+const loadTimeout = 5 * time.Second
+
+// Reloading is implemented by trust stores and keyrings that reload their contents
+type Reloading interface {
+	// Generation reloads the contents once the refresh period has passed, and returns
+	// a number that is incremented whenever loaded contents differ from the previous ones
+	Generation() uint64
+}
+
+// loadFunc loads contents from a source, and returns them with their fingerprint
+type loadFunc func(ctx context.Context) (contents interface{}, fingerprint []byte, err error)
+
+// reloader loads contents from a source, and reloads them once the refresh period has passed
+// since the last attempt. If reloading fails, previously loaded contents are kept.
+type reloader struct {
+	load    loadFunc
+	refresh time.Duration
+
+	lock        sync.Mutex
+	contents    interface{}
+	err         error // of the last attempt, if it failed
+	attemptedAt time.Time
+	fingerprint []byte // of the loaded contents
+	generation  uint64
+}
+
+func newReloader(load loadFunc, refresh time.Duration) *reloader {
+	return &reloader{
+		load:    load,
+		refresh: refresh,
+	}
+}
+
+// get returns the loaded contents and their generation, reloading them if the refresh period
+// has passed. Errors are only returned until contents were loaded once.
+func (r *reloader) get() (interface{}, uint64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.attemptedAt.IsZero() && time.Since(r.attemptedAt) < r.refresh {
+		return r.contents, r.generation, r.lastError()
+	}
+	r.attemptedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+
+	contents, fingerprint, err := r.load(ctx)
+	r.err = err
+	if err != nil {
+		return r.contents, r.generation, r.lastError()
+	}
+
+	if r.generation == 0 || !bytes.Equal(fingerprint, r.fingerprint) {
+		r.fingerprint = fingerprint
+		r.generation++
+	}
+	r.contents = contents
+	return r.contents, r.generation, nil
+}
+
+// lastError returns the error of the last attempt if no contents were loaded, r.lock must be held
+func (r *reloader) lastError() error {
+	if r.contents != nil {
+		return nil
+	}
+	return r.err
+}
+
+// Generation implements Reloading. Failed reloads keep the previous generation.
+func (r *reloader) Generation() uint64 {
+	_, generation, _ := r.get()
+	return generation
+}
@@ -0,0 +1,226 @@
+package validator
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// SignerPolicy constrains signing certificates in addition to the trust store.
+// Empty constraints allow any certificate.
+type SignerPolicy struct {
+	// CommonName specifies regular expression the whole subject common name must match
+	CommonName string `json:"commonName,omitempty"`
+
+	// OrganizationalUnit specifies regular expression one of whole subject organizational units must match
+	OrganizationalUnit string `json:"organizationalUnit,omitempty"`
+
+	// Emails specifies SAN emails, the certificate must have one of them. OpenPGP keys must have
+	// an identity with one of them, other constraints are never met by OpenPGP keys.
+	Emails []string `json:"emails,omitempty"`
+
+	// URIs specifies SAN URIs, the certificate must have one of them
+	URIs []string `json:"uris,omitempty"`
+
+	// PolicyOIDs specifies certificate policy OIDs, e.g. 1.3.6.1.4.1.7073.1.1, the certificate must have all of them
+	PolicyOIDs []string `json:"policyOIDs,omitempty"`
+
+	// ExtKeyUsageOIDs specifies extended key usage OIDs, the certificate must have all of them
+	// in addition to code signing
+	ExtKeyUsageOIDs []string `json:"extKeyUsageOIDs,omitempty"`
+
+	// Issuers specifies subject common names of intermediate CAs, one of them must issue the certificate
+	Issuers []string `json:"issuers,omitempty"`
+}
+
+// Validate returns error if regular expressions or OIDs of the policy are invalid
+func (p *SignerPolicy) Validate() error {
+	if _, err := regexp.Compile(p.CommonName); err != nil {
+		return errors.Annotate(err, "commonName")
+	}
+	if _, err := regexp.Compile(p.OrganizationalUnit); err != nil {
+		return errors.Annotate(err, "organizationalUnit")
+	}
+	for _, oid := range p.PolicyOIDs {
+		if _, err := parseOID(oid); err != nil {
+			return errors.Annotate(err, "policyOIDs")
+		}
+	}
+	for _, oid := range p.ExtKeyUsageOIDs {
+		if _, err := parseOID(oid); err != nil {
+			return errors.Annotate(err, "extKeyUsageOIDs")
+		}
+	}
+	return nil
+}
+
+// verify returns error if the signer certificate, verified with the chains, is not allowed by the policy
+func (p *SignerPolicy) verify(signer *x509.Certificate, chains [][]*x509.Certificate) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.CommonName != "" && !matchesRegexp(p.CommonName, signer.Subject.CommonName) {
+		return errors.Errorf("common name %q does not match %q", signer.Subject.CommonName, p.CommonName)
+	}
+
+	if p.OrganizationalUnit != "" {
+		var matched bool
+		for _, ou := range signer.Subject.OrganizationalUnit {
+			if matched = matchesRegexp(p.OrganizationalUnit, ou); matched {
+				break
+			}
+		}
+		if !matched {
+			return errors.Errorf("organizational units %q do not match %q", signer.Subject.OrganizationalUnit, p.OrganizationalUnit)
+		}
+	}
+
+	if len(p.Emails) > 0 && !containsAny(p.Emails, signer.EmailAddresses) {
+		return errors.Errorf("emails %q are not allowed", signer.EmailAddresses)
+	}
+
+	if len(p.URIs) > 0 {
+		uris := make([]string, len(signer.URIs))
+		for i, uri := range signer.URIs {
+			uris[i] = uri.String()
+		}
+		if !containsAny(p.URIs, uris) {
+			return errors.Errorf("URIs %q are not allowed", uris)
+		}
+	}
+
+	for _, oid := range p.PolicyOIDs {
+		if !containsOID(signer.PolicyIdentifiers, oid) {
+			return errors.Errorf("certificate policy %s is required", oid)
+		}
+	}
+
+	for _, oid := range p.ExtKeyUsageOIDs {
+		if !hasExtKeyUsage(signer, oid) {
+			return errors.Errorf("extended key usage %s is required", oid)
+		}
+	}
+
+	if len(p.Issuers) > 0 {
+		var issuers []string
+		for _, chain := range chains {
+			if len(chain) < 2 {
+				continue
+			}
+			issuer := chain[1].Subject.CommonName
+			for _, allowed := range p.Issuers {
+				if issuer == allowed {
+					return nil
+				}
+			}
+			issuers = append(issuers, issuer)
+		}
+		return errors.Errorf("issuers %q are not allowed", issuers)
+	}
+	return nil
+}
+
+// verifyOpenPGP returns error if the OpenPGP key is not allowed by the policy.
+// Constraints of X.509 certificates other than emails are never met by OpenPGP keys.
+func (p *SignerPolicy) verifyOpenPGP(signer *openpgp.Entity) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.CommonName != "" || p.OrganizationalUnit != "" || len(p.URIs) > 0 || len(p.PolicyOIDs) > 0 || len(p.ExtKeyUsageOIDs) > 0 || len(p.Issuers) > 0 {
+		return errors.New("policy constrains X.509 certificates")
+	}
+
+	if len(p.Emails) > 0 {
+		var emails []string
+		for _, identity := range signer.Identities {
+			if identity.UserId != nil {
+				emails = append(emails, identity.UserId.Email)
+			}
+		}
+		if !containsAny(p.Emails, emails) {
+			return errors.Errorf("emails %q are not allowed", emails)
+		}
+	}
+	return nil
+}
+
+// matchesRegexp returns true if the whole string matches the expression
+func matchesRegexp(expr, s string) bool {
+	// expressions are checked by Validate
+	matched, _ := regexp.MatchString("^(?:"+expr+")$", s)
+	return matched
+}
+
+func containsAny(allowed, values []string) bool {
+	for _, value := range values {
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extKeyUsages are the extended key usages that crypto/x509 parses into ExtKeyUsage
+// instead of UnknownExtKeyUsage, by OID
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"2.5.29.37.0":            x509.ExtKeyUsageAny,
+	"1.3.6.1.5.5.7.3.1":      x509.ExtKeyUsageServerAuth,
+	"1.3.6.1.5.5.7.3.2":      x509.ExtKeyUsageClientAuth,
+	"1.3.6.1.5.5.7.3.3":      x509.ExtKeyUsageCodeSigning,
+	"1.3.6.1.5.5.7.3.4":      x509.ExtKeyUsageEmailProtection,
+	"1.3.6.1.5.5.7.3.5":      x509.ExtKeyUsageIPSECEndSystem,
+	"1.3.6.1.5.5.7.3.6":      x509.ExtKeyUsageIPSECTunnel,
+	"1.3.6.1.5.5.7.3.7":      x509.ExtKeyUsageIPSECUser,
+	"1.3.6.1.5.5.7.3.8":      x509.ExtKeyUsageTimeStamping,
+	"1.3.6.1.5.5.7.3.9":      x509.ExtKeyUsageOCSPSigning,
+	"1.3.6.1.4.1.311.10.3.3": x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"2.16.840.1.113730.4.1":  x509.ExtKeyUsageNetscapeServerGatedCrypto,
+	"1.3.6.1.4.1.311.2.1.22": x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	"1.3.6.1.4.1.311.61.1.1": x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+// hasExtKeyUsage returns true if the certificate has the extended key usage with the OID
+func hasExtKeyUsage(cert *x509.Certificate, oid string) bool {
+	if usage, ok := extKeyUsages[oid]; ok {
+		for _, u := range cert.ExtKeyUsage {
+			if u == usage {
+				return true
+			}
+		}
+	}
+	return containsOID(cert.UnknownExtKeyUsage, oid)
+}
+
+func containsOID(oids []asn1.ObjectIdentifier, oid string) bool {
+	for _, o := range oids {
+		if o.String() == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOID parses dotted OID
+func parseOID(oid string) (asn1.ObjectIdentifier, error) {
+	var parsed asn1.ObjectIdentifier
+	for _, s := range strings.Split(oid, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid OID %q", oid)
+		}
+		parsed = append(parsed, n)
+	}
+	if len(parsed) < 2 {
+		return nil, errors.Errorf("invalid OID %q", oid)
+	}
+	return parsed, nil
+}
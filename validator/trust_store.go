@@ -0,0 +1,102 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-phorce/dolly/xpki/certutil"
+	"github.com/juju/errors"
+)
+
+// TrustStore provides the root certificates that signer chains must verify against
+type TrustStore interface {
+	// Roots returns the pool of trusted root certificates
+	Roots() (*x509.CertPool, error)
+}
+
+// CertsLoader loads trusted root certificates from a source
+type CertsLoader func(ctx context.Context) ([]*x509.Certificate, error)
+
+// reloadingTrustStore implements TrustStore by loading roots from a source
+// and reloading them once the refresh period has passed
+type reloadingTrustStore struct {
+	*reloader
+}
+
+// NewTrustStore returns a trust store that loads roots with the loader,
+// and reloads them after the refresh period
+func NewTrustStore(load CertsLoader, refresh time.Duration) TrustStore {
+	return &reloadingTrustStore{newReloader(func(ctx context.Context) (interface{}, []byte, error) {
+		certs, err := load(ctx)
+		if err == nil && len(certs) == 0 {
+			err = errors.New("no trusted root certificates found")
+		}
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		// the fingerprint does not depend on the order certificates are loaded in
+		raw := make([][]byte, len(certs))
+		roots := x509.NewCertPool()
+		for i, cert := range certs {
+			roots.AddCert(cert)
+			raw[i] = cert.Raw
+		}
+		sort.Slice(raw, func(i, j int) bool { return bytes.Compare(raw[i], raw[j]) < 0 })
+		fingerprint := sha256.Sum256(bytes.Join(raw, nil))
+		return roots, fingerprint[:], nil
+	}, refresh)}
+}
+
+// Roots returns the pool of trusted root certificates. If reloading fails,
+// previously loaded roots are returned.
+func (s *reloadingTrustStore) Roots() (*x509.CertPool, error) {
+	roots, _, err := s.get()
+	if err != nil {
+		return nil, errors.Annotate(err, "api=Roots, reason=load")
+	}
+	return roots.(*x509.CertPool), nil
+}
+
+// LoadCertsFromFile returns a loader of PEM encoded certificates from the file
+func LoadCertsFromFile(file string) CertsLoader {
+	return func(context.Context) ([]*x509.Certificate, error) {
+		certs, err := certutil.LoadChainFromPEM(file)
+		if err != nil {
+			return nil, errors.Annotatef(err, "file=%q", file)
+		}
+		return certs, nil
+	}
+}
+
+// LoadCertsFromDir returns a loader of PEM encoded certificates from
+// *.pem and *.crt files in the directory
+func LoadCertsFromDir(dir string) CertsLoader {
+	return func(ctx context.Context) ([]*x509.Certificate, error) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		var certs []*x509.Certificate
+		for _, f := range files {
+			ext := strings.ToLower(filepath.Ext(f.Name()))
+			if f.IsDir() || (ext != ".pem" && ext != ".crt") {
+				continue
+			}
+			chain, err := LoadCertsFromFile(filepath.Join(dir, f.Name()))(ctx)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			certs = append(certs, chain...)
+		}
+		return certs, nil
+	}
+}
@@ -1,15 +1,69 @@
 package validator
 
 import (
+	"crypto"
+	_ "crypto/sha256" // registers SHA-256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
 	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"github.com/go-phorce/dolly/xpki/certutil"
 )
 
+// Hash algorithms of digests and signatures
+const (
+	HashSHA256 = "sha256"
+	HashSHA384 = "sha384"
+	HashSHA512 = "sha512"
+)
+
+// hashAlgorithms maps supported hash algorithms to their hash functions
+var hashAlgorithms = map[string]crypto.Hash{
+	HashSHA256: crypto.SHA256,
+	HashSHA384: crypto.SHA384,
+	HashSHA512: crypto.SHA512,
+}
+
 // SHA256Digest return sha256 digest prefixed with sha256:
 func SHA256Digest(b []byte) string {
 	hash := certutil.SHA256([]byte(b))
 	manifestDigest := hex.EncodeToString(hash)
 	return fmt.Sprintf("sha256:%s", manifestDigest)
 }
+
+// NormalizeHashAlgorithm returns the name of the hash algorithm as used in digests,
+// e.g. sha384 for SHA384 or SHA-384
+func NormalizeHashAlgorithm(algorithm string) string {
+	return strings.Replace(strings.ToLower(algorithm), "-", "", -1)
+}
+
+// IsSupportedHashAlgorithm returns true for SHA-256, SHA-384 and SHA-512
+func IsSupportedHashAlgorithm(algorithm string) bool {
+	_, ok := hashAlgorithms[NormalizeHashAlgorithm(algorithm)]
+	return ok
+}
+
+// Digest returns the digest of b computed with the hash algorithm, prefixed with <algorithm>:
+func Digest(algorithm string, b []byte) (string, error) {
+	algorithm = NormalizeHashAlgorithm(algorithm)
+	hash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+	h := hash.New()
+	h.Write(b)
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// MatchDigest computes the digest of b with the algorithm of the expected digest <algorithm>:<hex>,
+// and returns it with true if it is the expected digest. Digests with unsupported algorithms
+// are computed with SHA-256 and never match.
+func MatchDigest(expected string, b []byte) (string, bool) {
+	algorithm := strings.SplitN(expected, ":", 2)[0]
+	digest, err := Digest(algorithm, b)
+	if err != nil {
+		return SHA256Digest(b), false
+	}
+	return digest, digest == expected
+}
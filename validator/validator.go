@@ -3,106 +3,156 @@ package validator
 import (
 	"bytes"
 	"crypto/x509"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"strings"
 
-	"git.soma.salesforce.com/kuleana/go-pkg/cms"
 	"github.com/go-phorce/dolly/xpki/certutil"
 	"github.com/juju/errors"
 )
 
-// ValidateManifestSignature validates manifest signature
-func ValidateManifestSignature(manifest, manifestSig string) (bool, string, error) {
-	manifestSigBytes := []byte(manifestSig)
-	sig, err := loadSignatureResponse(manifestSigBytes)
-	if err != nil {
-		return false, "", errors.Errorf("api=ValidateManifestSignature, reason=loadSignatureResponse, err=%v", err)
+// ValidateManifestSignature validates manifest signature with the verifier registered
+// for its signature format, and returns the hex manifest digest computed with the hash
+// algorithm of the signature. X.509 signer certificates must chain to a root of the trust
+// store, CA certificates carried in the signature are only used as intermediates.
+// OpenPGP signatures must be made by a key of the keyring. Nil opts only allow SHA-256
+// and trust no signer.
+func ValidateManifestSignature(manifest, manifestSig string, opts *VerifyOptions) (bool, string, error) {
+	if opts == nil {
+		opts = &VerifyOptions{HashAlgorithms: []string{HashSHA256}}
 	}
 
-	manifestBytes := []byte(manifest)
-	manifestDigest := hex.EncodeToString(certutil.SHA256(manifestBytes))
-	artifact, err := findArtifactInSignatureResponse(sig, manifestDigest)
+	manifestSigBytes := []byte(manifestSig)
+	sig, err := LoadSignatureResponse(manifestSigBytes)
 	if err != nil {
-		return false, "", errors.Errorf("api=ValidateManifestSignature, reason=findArtifactInSignatureResponse, err=%v", err)
+		return false, "", errors.Annotatef(ErrInvalidSignature, "api=ValidateManifestSignature, reason=LoadSignatureResponse, err=%v", err)
 	}
 
-	bundle, bundleStatus, err := certutil.VerifyBundleFromPEM([]byte(artifact.Certificate), []byte(artifact.CA), nil)
+	manifestBytes := []byte(manifest)
+	artifact, manifestDigest, err := findArtifactInSignatureResponse(sig, manifestBytes, opts.HashAlgorithms)
 	if err != nil {
-		return false, "", errors.Errorf("api=ValidateManifestSignature, reason=VerifyBundleFromPEM, err=%v", err)
+		return false, "", errors.Annotate(err, "api=ValidateManifestSignature")
 	}
 
-	if bundleStatus.IsUntrusted() {
-		return false, "", errors.Errorf("api=ValidateManifestSignature, reason='signing certificate is not trusted', certificate=%q, ca=%q", artifact.Certificate, artifact.CA)
+	verifier := formatVerifier(artifact.SignatureFormat)
+	if verifier == nil {
+		return false, "", errors.Annotatef(ErrInvalidSignature, "api=ValidateManifestSignature, reason='not supported signature format', signatureFormat=%q", artifact.SignatureFormat)
 	}
 
-	switch artifact.SignatureFormat {
-	case "cms-detached", "pkcs7-detached":
-		err = verifyDetached(manifestBytes, artifact, bundle.RootCert)
-		if err != nil {
-			return false, "", errors.Errorf("api=ValidateManifestSignature, reason=verifyDetached, artifactName=%q, err=%v", artifact.Name, err)
-		}
-	default:
-		return false, "", errors.Errorf("api=ValidateManifestSignature, reason='not supported signature format', signatureFormat=%q, err=%v", artifact.SignatureFormat, err)
+	// verifiers return errors caused by ErrUntrustedSigner, ErrSignerNotAllowed or ErrInvalidSignature
+	if err = verifier.Verify(manifestBytes, artifact, opts); err != nil {
+		return false, "", errors.Annotatef(err, "api=ValidateManifestSignature, signatureFormat=%q, artifactName=%q", artifact.SignatureFormat, artifact.Name)
 	}
 
 	return true, manifestDigest, nil
 }
 
-// loadSignatureResponse loads and decodes a SignatureResponse
-func loadSignatureResponse(b []byte) (*SignatureResponse, error) {
+// LoadSignatureResponse loads and decodes a SignatureResponse
+func LoadSignatureResponse(b []byte) (*SignatureResponse, error) {
 	r := bytes.NewReader(b)
 	res := new(SignatureResponse)
 	return res, json.NewDecoder(r).Decode(res)
 }
 
-// findArtifactInSignatureResponse finds corresponding artifact in the signature response
-func findArtifactInSignatureResponse(sig *SignatureResponse, hash string) (*SignatureInfo, error) {
-	artifact, err := sig.getSignatureInfoWithHash(hash)
-	if err != nil {
-		return nil, errors.Errorf("api=findArtifactInSignatureResponse, reason=getSignatureInfoWithHash, hash=%q", hash)
+// findArtifactInSignatureResponse finds the artifact of the manifest in the signature response,
+// and returns it with the hex manifest digest computed with its hash algorithm. SHA-256 is
+// assumed if the artifact has no hash algorithm. Artifacts with hash algorithms that are not
+// allowed are only returned as ErrHashNotAllowed if no other artifact matches.
+func findArtifactInSignatureResponse(sig *SignatureResponse, manifest []byte, allowed []string) (*SignatureInfo, string, error) {
+	var notAllowed string
+	digests := map[string]string{}
+	for _, artifact := range sig.Signatures {
+		algorithm := NormalizeHashAlgorithm(artifact.HashAlg)
+		if algorithm == "" {
+			algorithm = HashSHA256
+		}
+		if !IsSupportedHashAlgorithm(algorithm) {
+			notAllowed = algorithm
+			continue
+		}
+
+		digest, ok := digests[algorithm]
+		if !ok {
+			// the algorithm is supported
+			digest, _ = Digest(algorithm, manifest)
+			digest = strings.TrimPrefix(digest, algorithm+":")
+			digests[algorithm] = digest
+		}
+		if !strings.EqualFold(artifact.Hash, digest) {
+			continue
+		}
+		if !allowsHashAlgorithm(allowed, algorithm) {
+			notAllowed = algorithm
+			continue
+		}
+		return artifact, digest, nil
 	}
-	return artifact, nil
-}
 
-func verifyDetached(input []byte, artifact *SignatureInfo, rootCert *x509.Certificate) error {
-	opts := x509.VerifyOptions{
-		KeyUsages: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageCodeSigning,
-		},
+	if notAllowed != "" {
+		return nil, "", errors.Annotatef(ErrHashNotAllowed, "reason=findArtifactInSignatureResponse, hash_alg=%q, allowed=%q", notAllowed, allowed)
 	}
+	return nil, "", errors.Annotatef(ErrSignatureNotFound, "reason=findArtifactInSignatureResponse, digest=%q", SHA256Digest(manifest))
+}
 
-	if rootCert != nil {
-		roots := x509.NewCertPool()
-		roots.AddCert(rootCert)
-		opts.Roots = roots
+// allowsHashAlgorithm returns true if the algorithm is one of the allowed algorithms,
+// any supported algorithm is allowed if none are
+func allowsHashAlgorithm(allowed []string, algorithm string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if NormalizeHashAlgorithm(a) == algorithm {
+			return true
+		}
 	}
+	return false
+}
 
-	der, err := base64.StdEncoding.DecodeString(artifact.Signature)
+// verifySigner verifies the signer certificate of the artifact against
+// the trust store, and returns options to verify the signature with
+func verifySigner(artifact *SignatureInfo, trustStore TrustStore) (*signerOptions, error) {
+	if trustStore == nil {
+		return nil, errors.New("no trust store")
+	}
+	roots, err := trustStore.Roots()
 	if err != nil {
-		return errors.Annotatef(err, "unable to decode signature")
+		return nil, errors.Trace(err)
 	}
 
-	sd, err := cms.ParseSignedData(der)
+	signer, err := certutil.ParseFromPEM([]byte(artifact.Certificate))
 	if err != nil {
-		return errors.Annotatef(err, "unable to parse signed data")
+		return nil, errors.Annotate(err, "unable to parse signing certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	if len(artifact.CA) > 0 {
+		chain, err := certutil.ParseChainFromPEM([]byte(artifact.CA))
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to parse CA bundle")
+		}
+		for _, cert := range chain {
+			intermediates.AddCert(cert)
+		}
 	}
 
-	_, err = sd.VerifyDetached(input, opts, nil)
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageCodeSigning,
+		},
+	}
+
+	chains, err := signer.Verify(opts)
 	if err != nil {
-		return errors.Annotatef(err, "reason=verifyDetached, artifact=%q, sig_id=%s", artifact.Name, artifact.SigID)
+		return nil, errors.Trace(err)
 	}
-	return nil
+
+	return &signerOptions{verifyOptions: opts, signer: signer, chains: chains}, nil
 }
 
-// getSignatureInfoWithHash finds a signature info in the response by hash
-func (s *SignatureResponse) getSignatureInfoWithHash(hash string) (*SignatureInfo, error) {
-	if s != nil && len(s.Signatures) > 0 {
-		for _, a := range s.Signatures {
-			if a.Hash == hash {
-				return a, nil
-			}
-		}
-	}
-	return nil, errors.Errorf("api=getSignatureInfoWithHash, hash=%q", hash)
+// signerOptions specifies the verified signer and options to verify its signatures with
+type signerOptions struct {
+	verifyOptions x509.VerifyOptions
+	signer        *x509.Certificate
+	chains        [][]*x509.Certificate // verified chains of the signer, from the signer to a root
 }
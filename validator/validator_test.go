@@ -0,0 +1,489 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.soma.salesforce.com/kuleana/go-pkg/cms"
+	"github.com/go-phorce/dolly/xpki/certutil"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// testIssuer is a test CA certificate with its key
+type testIssuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var serial int64
+
+func newTestCert(t *testing.T, template *x509.Certificate, issuer *testIssuer) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, parentKey := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testIssuer{cert: cert, key: key}
+}
+
+func newTestCA(t *testing.T, cn string, issuer *testIssuer) *testIssuer {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, issuer)
+}
+
+func newTestSigner(t *testing.T, cn string, issuer *testIssuer) *testIssuer {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, issuer)
+}
+
+func toPEM(certs ...*x509.Certificate) string {
+	var s string
+	for _, cert := range certs {
+		s += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return s
+}
+
+// signManifest returns a signature response with a detached CMS signature of the manifest
+func signManifest(t *testing.T, manifest string, signer *testIssuer, ca ...*x509.Certificate) string {
+	der, err := cms.SignDetached([]byte(manifest), []*x509.Certificate{signer.cert}, signer.key)
+	require.NoError(t, err)
+	return signatureResponse(t, manifest, "cms-detached", base64.StdEncoding.EncodeToString(der), toPEM(signer.cert), toPEM(ca...))
+}
+
+// signatureResponse returns a signature response with the signature of the manifest
+func signatureResponse(t *testing.T, manifest, format, signature, certificate, ca string) string {
+	res := &SignatureResponse{
+		Signatures: []*SignatureInfo{
+			{
+				Name:            "manifest.json",
+				SignatureFormat: format,
+				HashAlg:         "SHA256",
+				Hash:            hex.EncodeToString(certutil.SHA256([]byte(manifest))),
+				Signature:       signature,
+				Certificate:     certificate,
+				CA:              ca,
+			},
+		},
+	}
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func staticTrustStore(certs ...*x509.Certificate) TrustStore {
+	return NewTrustStore(func(context.Context) ([]*x509.Certificate, error) { return certs, nil }, time.Hour)
+}
+
+func Test_ValidateManifestSignature(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	signer := newTestSigner(t, "signer", intermediate)
+
+	rogueRoot := newTestCA(t, "root", nil)
+	rogueSigner := newTestSigner(t, "signer", rogueRoot)
+
+	t.Run("Trusted", func(t *testing.T) {
+		sig := signManifest(t, manifest, signer, intermediate.cert, root.cert)
+		status, digest, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{TrustStore: staticTrustStore(root.cert)})
+		require.NoError(t, err)
+		require.True(t, status)
+		require.Equal(t, hex.EncodeToString(certutil.SHA256([]byte(manifest))), digest)
+	})
+
+	t.Run("RootCarriedInSignature", func(t *testing.T) {
+		sig := signManifest(t, manifest, rogueSigner, rogueRoot.cert)
+		status, _, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{TrustStore: staticTrustStore(root.cert)})
+		require.Error(t, err)
+		require.False(t, status)
+		require.Equal(t, ErrUntrustedSigner, errors.Cause(err))
+	})
+
+	t.Run("MissingIntermediate", func(t *testing.T) {
+		sig := signManifest(t, manifest, signer)
+		_, _, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{TrustStore: staticTrustStore(root.cert)})
+		require.Equal(t, ErrUntrustedSigner, errors.Cause(err))
+	})
+
+	t.Run("TamperedManifest", func(t *testing.T) {
+		sig := signManifest(t, manifest, signer, intermediate.cert)
+		_, _, err := ValidateManifestSignature(`{"schemaVersion":1}`, sig, &VerifyOptions{TrustStore: staticTrustStore(root.cert)})
+		require.Equal(t, ErrSignatureNotFound, errors.Cause(err))
+	})
+
+	t.Run("BadSignature", func(t *testing.T) {
+		sig := signManifest(t, `{"schemaVersion":1}`, signer, intermediate.cert)
+		res, err := LoadSignatureResponse([]byte(sig))
+		require.NoError(t, err)
+		res.Signatures[0].Hash = hex.EncodeToString(certutil.SHA256([]byte(manifest)))
+		b, err := json.Marshal(res)
+		require.NoError(t, err)
+
+		_, _, err = ValidateManifestSignature(manifest, string(b), &VerifyOptions{TrustStore: staticTrustStore(root.cert)})
+		require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+	})
+
+	t.Run("NilOptions", func(t *testing.T) {
+		sig := signManifest(t, manifest, signer, intermediate.cert)
+		status, _, err := ValidateManifestSignature(manifest, sig, nil)
+		require.False(t, status)
+		require.Equal(t, ErrUntrustedSigner, errors.Cause(err))
+	})
+}
+
+func Test_EmbeddedSignature(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	root := newTestCA(t, "root", nil)
+	signer := newTestSigner(t, "signer", root)
+	opts := &VerifyOptions{TrustStore: staticTrustStore(root.cert)}
+
+	sign := func(content string) string {
+		der, err := cms.Sign([]byte(content), []*x509.Certificate{signer.cert}, signer.key)
+		require.NoError(t, err)
+		return signatureResponse(t, manifest, "cms", base64.StdEncoding.EncodeToString(der), toPEM(signer.cert), "")
+	}
+
+	status, _, err := ValidateManifestSignature(manifest, sign(manifest), opts)
+	require.NoError(t, err)
+	require.True(t, status)
+
+	_, _, err = ValidateManifestSignature(manifest, sign(`{"schemaVersion":1}`), opts)
+	require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+}
+
+func Test_GPGSignature(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	key, err := openpgp.NewEntity("signer", "", "platform@example.com", nil)
+	require.NoError(t, err)
+	rogueKey, err := openpgp.NewEntity("signer", "", "platform@example.com", nil)
+	require.NoError(t, err)
+	keyring := NewKeyring(func(context.Context) (openpgp.EntityList, error) { return openpgp.EntityList{key}, nil }, time.Hour)
+
+	sign := func(signer *openpgp.Entity, content string) string {
+		var sig bytes.Buffer
+		require.NoError(t, openpgp.ArmoredDetachSign(&sig, signer, strings.NewReader(content), nil))
+
+		// the embedded public key is not trusted
+		var pub bytes.Buffer
+		w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+		require.NoError(t, err)
+		require.NoError(t, signer.Serialize(w))
+		require.NoError(t, w.Close())
+
+		res, err := LoadSignatureResponse([]byte(signatureResponse(t, manifest, "gpg", sig.String(), "", "")))
+		require.NoError(t, err)
+		res.Signatures[0].GPGPubKey = pub.String()
+		b, err := json.Marshal(res)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	testCases := []struct {
+		name    string
+		sig     string
+		opts    *VerifyOptions
+		allowed bool
+		cause   error
+	}{
+		{name: "Trusted", sig: sign(key, manifest), opts: &VerifyOptions{Keyring: keyring}, allowed: true},
+		{name: "Email", sig: sign(key, manifest), opts: &VerifyOptions{Keyring: keyring, SignerPolicy: &SignerPolicy{Emails: []string{"platform@example.com"}}}, allowed: true},
+		{name: "OtherEmail", sig: sign(key, manifest), opts: &VerifyOptions{Keyring: keyring, SignerPolicy: &SignerPolicy{Emails: []string{"security@example.com"}}}, cause: ErrSignerNotAllowed},
+		{name: "X509Policy", sig: sign(key, manifest), opts: &VerifyOptions{Keyring: keyring, SignerPolicy: &SignerPolicy{CommonName: "signer"}}, cause: ErrSignerNotAllowed},
+		{name: "UnknownKey", sig: sign(rogueKey, manifest), opts: &VerifyOptions{Keyring: keyring}, cause: ErrUntrustedSigner},
+		{name: "NoKeyring", sig: sign(key, manifest), opts: &VerifyOptions{}, cause: ErrUntrustedSigner},
+		{name: "BadSignature", sig: sign(key, `{"schemaVersion":1}`), opts: &VerifyOptions{Keyring: keyring}, cause: ErrInvalidSignature},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, _, err := ValidateManifestSignature(manifest, tc.sig, tc.opts)
+			if tc.allowed {
+				require.NoError(t, err)
+				require.True(t, status)
+				return
+			}
+			require.Equal(t, tc.cause, errors.Cause(err))
+		})
+	}
+}
+
+func Test_RegisterFormatVerifier(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	sig := signatureResponse(t, manifest, "test", "signature", "", "")
+
+	_, _, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{})
+	require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+
+	RegisterFormatVerifier("test", FormatVerifierFunc(func(manifest []byte, artifact *SignatureInfo, opts *VerifyOptions) error {
+		if artifact.Signature != "signature" {
+			return ErrInvalidSignature
+		}
+		return nil
+	}))
+	defer RegisterFormatVerifier("test", nil)
+
+	status, _, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{})
+	require.NoError(t, err)
+	require.True(t, status)
+}
+
+func Test_HashAlgorithms(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	root := newTestCA(t, "root", nil)
+	signer := newTestSigner(t, "signer", root)
+	der, err := cms.SignDetached([]byte(manifest), []*x509.Certificate{signer.cert}, signer.key)
+	require.NoError(t, err)
+
+	// sign returns signature response with the signature hashed with each of the algorithms
+	sign := func(algorithms ...string) string {
+		res := new(SignatureResponse)
+		for _, algorithm := range algorithms {
+			hash, alg := "0123", algorithm
+			if alg == "" {
+				alg = HashSHA256
+			}
+			if digest, err := Digest(alg, []byte(manifest)); err == nil {
+				hash = strings.SplitN(digest, ":", 2)[1]
+			}
+			res.Signatures = append(res.Signatures, &SignatureInfo{
+				Name:            "manifest.json",
+				SignatureFormat: "cms-detached",
+				HashAlg:         algorithm,
+				Hash:            hash,
+				Signature:       base64.StdEncoding.EncodeToString(der),
+				Certificate:     toPEM(signer.cert),
+			})
+		}
+		b, err := json.Marshal(res)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	testCases := []struct {
+		name       string
+		algorithms []string
+		allowed    []string
+		digest     string
+		cause      error
+	}{
+		{name: "SHA256", algorithms: []string{"SHA256"}, digest: HashSHA256},
+		{name: "NoHashAlg", algorithms: []string{""}, digest: HashSHA256},
+		{name: "SHA384", algorithms: []string{"SHA-384"}, allowed: []string{"sha384", "sha512"}, digest: HashSHA384},
+		{name: "SHA512", algorithms: []string{"sha512"}, allowed: []string{"sha384", "sha512"}, digest: HashSHA512},
+		{name: "AllowedOfMany", algorithms: []string{"SHA256", "SHA384"}, allowed: []string{"sha384"}, digest: HashSHA384},
+		{name: "NotAllowed", algorithms: []string{"SHA256"}, allowed: []string{"sha384"}, cause: ErrHashNotAllowed},
+		{name: "Unsupported", algorithms: []string{"SHA1"}, cause: ErrHashNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, digest, err := ValidateManifestSignature(manifest, sign(tc.algorithms...), &VerifyOptions{TrustStore: staticTrustStore(root.cert), HashAlgorithms: tc.allowed})
+			if tc.cause != nil {
+				require.Equal(t, tc.cause, errors.Cause(err))
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, status)
+			expected, err := Digest(tc.digest, []byte(manifest))
+			require.NoError(t, err)
+			require.Equal(t, expected, tc.digest+":"+digest)
+		})
+	}
+
+	// nil options only allow SHA-256
+	_, _, err = ValidateManifestSignature(manifest, sign("SHA512"), nil)
+	require.Equal(t, ErrHashNotAllowed, errors.Cause(err))
+}
+
+func Test_MatchDigest(t *testing.T) {
+	b := []byte(`{"schemaVersion":2}`)
+	for _, algorithm := range []string{HashSHA256, HashSHA384, HashSHA512} {
+		digest, err := Digest(algorithm, b)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(digest, algorithm+":"))
+
+		matched, ok := MatchDigest(digest, b)
+		require.True(t, ok)
+		require.Equal(t, digest, matched)
+
+		_, ok = MatchDigest(digest, []byte(`{"schemaVersion":1}`))
+		require.False(t, ok)
+	}
+	digest, err := Digest("SHA-256", b)
+	require.NoError(t, err)
+	require.Equal(t, SHA256Digest(b), digest)
+
+	matched, ok := MatchDigest("md5:0123", b)
+	require.False(t, ok)
+	require.Equal(t, SHA256Digest(b), matched)
+
+	_, err = Digest("sha1", b)
+	require.Error(t, err)
+}
+
+func Test_SignerPolicy(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	root := newTestCA(t, "root", nil)
+	platformCA := newTestCA(t, "platform-ca", root)
+	otherCA := newTestCA(t, "other-ca", root)
+	uri, err := url.Parse("spiffe://example.com/platform/signer")
+	require.NoError(t, err)
+	signer := newTestCert(t, &x509.Certificate{
+		Subject:            pkix.Name{CommonName: "platform-signer", OrganizationalUnit: []string{"Engineering", "Platform"}},
+		EmailAddresses:     []string{"platform@example.com"},
+		URIs:               []*url.URL{uri},
+		PolicyIdentifiers:  []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 7073, 1, 1}},
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning, x509.ExtKeyUsageTimeStamping},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 7073, 2, 1}},
+	}, platformCA)
+	otherSigner := newTestSigner(t, "platform-signer", otherCA)
+
+	testCases := []struct {
+		name    string
+		policy  SignerPolicy
+		signer  *testIssuer
+		ca      *testIssuer
+		allowed bool
+	}{
+		{name: "Empty", signer: signer, ca: platformCA, allowed: true},
+		{name: "CommonName", policy: SignerPolicy{CommonName: "platform-.*"}, signer: signer, ca: platformCA, allowed: true},
+		{name: "CommonNamePrefix", policy: SignerPolicy{CommonName: "platform"}, signer: signer, ca: platformCA},
+		{name: "OrganizationalUnit", policy: SignerPolicy{OrganizationalUnit: "Platform"}, signer: signer, ca: platformCA, allowed: true},
+		{name: "OtherOrganizationalUnit", policy: SignerPolicy{OrganizationalUnit: "Security"}, signer: signer, ca: platformCA},
+		{name: "Email", policy: SignerPolicy{Emails: []string{"platform@example.com"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "OtherEmail", policy: SignerPolicy{Emails: []string{"security@example.com"}}, signer: signer, ca: platformCA},
+		{name: "URI", policy: SignerPolicy{URIs: []string{"spiffe://example.com/platform/signer"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "NoURI", policy: SignerPolicy{URIs: []string{"spiffe://example.com/platform/signer"}}, signer: otherSigner, ca: otherCA},
+		{name: "PolicyOID", policy: SignerPolicy{PolicyOIDs: []string{"1.3.6.1.4.1.7073.1.1"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "MissingPolicyOID", policy: SignerPolicy{PolicyOIDs: []string{"1.3.6.1.4.1.7073.1.2"}}, signer: signer, ca: platformCA},
+		{name: "ExtKeyUsageOID", policy: SignerPolicy{ExtKeyUsageOIDs: []string{"1.3.6.1.4.1.7073.2.1"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "MissingExtKeyUsageOID", policy: SignerPolicy{ExtKeyUsageOIDs: []string{"1.3.6.1.4.1.7073.2.1"}}, signer: otherSigner, ca: otherCA},
+		{name: "KnownExtKeyUsageOID", policy: SignerPolicy{ExtKeyUsageOIDs: []string{"1.3.6.1.5.5.7.3.8", "1.3.6.1.4.1.7073.2.1"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "MissingKnownExtKeyUsageOID", policy: SignerPolicy{ExtKeyUsageOIDs: []string{"1.3.6.1.5.5.7.3.8"}}, signer: otherSigner, ca: otherCA},
+		{name: "Issuer", policy: SignerPolicy{Issuers: []string{"platform-ca"}}, signer: signer, ca: platformCA, allowed: true},
+		{name: "OtherIssuer", policy: SignerPolicy{Issuers: []string{"platform-ca"}}, signer: otherSigner, ca: otherCA},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.policy.Validate())
+			sig := signManifest(t, manifest, tc.signer, tc.ca.cert)
+			status, _, err := ValidateManifestSignature(manifest, sig, &VerifyOptions{TrustStore: staticTrustStore(root.cert), SignerPolicy: &tc.policy})
+			if tc.allowed {
+				require.NoError(t, err)
+				require.True(t, status)
+				return
+			}
+			require.Equal(t, ErrSignerNotAllowed, errors.Cause(err))
+		})
+	}
+
+	require.Error(t, (&SignerPolicy{CommonName: "("}).Validate())
+	require.Error(t, (&SignerPolicy{PolicyOIDs: []string{"1.x"}}).Validate())
+}
+
+func Test_TrustStoreReload(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	loads := 0
+	trustStore := NewTrustStore(func(context.Context) ([]*x509.Certificate, error) {
+		loads++
+		if loads > 1 {
+			return nil, x509.UnknownAuthorityError{}
+		}
+		return []*x509.Certificate{root.cert}, nil
+	}, 0)
+
+	roots, err := trustStore.Roots()
+	require.NoError(t, err)
+	require.NotNil(t, roots)
+
+	// failed reloads keep previously loaded roots
+	reloaded, err := trustStore.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, reloaded)
+	require.Equal(t, 2, loads)
+}
+
+func Test_ReloadAttempts(t *testing.T) {
+	loads := 0
+	trustStore := NewTrustStore(func(ctx context.Context) ([]*x509.Certificate, error) {
+		loads++
+		_, ok := ctx.Deadline()
+		require.True(t, ok, "loads are bounded")
+		return nil, x509.UnknownAuthorityError{}
+	}, time.Hour)
+
+	_, err := trustStore.Roots()
+	require.Error(t, err)
+
+	// failed loads are not retried before the refresh period has passed
+	_, err = trustStore.Roots()
+	require.Error(t, err)
+	require.Equal(t, uint64(0), trustStore.(Reloading).Generation())
+	require.Equal(t, 1, loads)
+}
+
+func Test_ReloadGeneration(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	otherRoot := newTestCA(t, "other-root", nil)
+	certs := []*x509.Certificate{root.cert}
+	trustStore := NewTrustStore(func(context.Context) ([]*x509.Certificate, error) { return certs, nil }, 0).(Reloading)
+
+	require.Equal(t, uint64(1), trustStore.Generation())
+	require.Equal(t, uint64(1), trustStore.Generation(), "reloading the same roots")
+	certs = []*x509.Certificate{root.cert, otherRoot.cert}
+	require.Equal(t, uint64(2), trustStore.Generation())
+
+	key, err := openpgp.NewEntity("signer", "", "platform@example.com", nil)
+	require.NoError(t, err)
+	otherKey, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	require.NoError(t, err)
+	keys := openpgp.EntityList{key}
+	keyring := NewKeyring(func(context.Context) (openpgp.EntityList, error) { return keys, nil }, 0).(Reloading)
+
+	require.Equal(t, uint64(1), keyring.Generation())
+	require.Equal(t, uint64(1), keyring.Generation(), "reloading the same keys")
+	keys = openpgp.EntityList{otherKey}
+	require.Equal(t, uint64(2), keyring.Generation())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Causes of image verification failures, reported in Status.Details.Causes
+const (
+	causeManifestNotFound      metav1.CauseType = "ManifestNotFound"          // manifest could not be fetched
+	causeDigestMismatch        metav1.CauseType = "DigestMismatch"            // manifest does not have the referenced digest
+	causeManifestRewritten     metav1.CauseType = "ManifestRewritten"         // manifest does not have the digest reported by the registry
+	causeSignatureMissing      metav1.CauseType = "SignatureMissing"          // no signature of the manifest
+	causeSignatureAccessDenied metav1.CauseType = "SignatureAccessDenied"     // signature store refused access to the signature
+	causeStoreUnavailable      metav1.CauseType = "SignatureStoreUnavailable" // signature store could not be reached or failed
+	causeStoreError            metav1.CauseType = "SignatureStoreError"       // signature store failed for a reason that is not transient
+	causeUntrustedChain        metav1.CauseType = "UntrustedChain"            // signer does not chain to the trust anchors
+	causeHashNotAllowed        metav1.CauseType = "HashAlgorithmNotAllowed"   // manifest hash algorithm is not allowed by policy
+	causeSignerNotAllowed      metav1.CauseType = "SignerNotAllowed"          // trusted signer is not allowed by policy
+	causeBadSignature          metav1.CauseType = "BadSignature"              // signature is malformed or does not match the manifest
+	causeCommitNotAllowed      metav1.CauseType = "CommitNotAllowed"          // commit metadata is not allowed by policy
+	causeRoleNotAllowed        metav1.CauseType = "RoleNotAllowed"            // requestor or signer role is not allowed by policy
+	causeTimeout               metav1.CauseType = "VerificationTimeout"       // verification did not complete before the deadline
+	causeUnsupportedKind       metav1.CauseType = "UnsupportedKind"           // kind has no known pod spec location
+	causeUndecodableObject     metav1.CauseType = "UndecodableObject"         // admitted object could not be decoded
+)
+
+// verificationError describes why an image failed verification
+type verificationError struct {
+	cause   metav1.CauseType
+	message string
+}
+
+func newVerificationError(cause metav1.CauseType, format string, args ...interface{}) *verificationError {
+	return &verificationError{
+		cause:   cause,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error returns the message of the verification error
+func (e *verificationError) Error() string {
+	return e.message
+}
+
+// verificationCause returns status cause of the container image verification error.
+// The field of the cause is derived from the JSON patch path of the image.
+func verificationCause(err error, container, image, imagePath string) metav1.StatusCause {
+	cause := causeBadSignature
+	if verr, ok := err.(*verificationError); ok {
+		cause = verr.cause
+	}
+
+	return metav1.StatusCause{
+		Type:    cause,
+		Message: fmt.Sprintf("container %q, image %q: %s: %v", container, image, cause, err),
+		Field:   fieldPath(imagePath),
+	}
+}
+
+// fieldPath converts JSON patch path /spec/containers/0/image to field path spec.containers[0].image
+func fieldPath(patchPath string) string {
+	var field string
+	for _, segment := range strings.Split(strings.TrimPrefix(patchPath, "/"), "/") {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			field += "[" + segment + "]"
+			continue
+		}
+		if field != "" {
+			field += "."
+		}
+		field += segment
+	}
+	return field
+}
@@ -4,18 +4,30 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
 
+const (
+	admissionReviewKind = "AdmissionReview"
+	admissionV1         = "admission.k8s.io/v1"
+	admissionV1beta1    = "admission.k8s.io/v1beta1"
+
+	// reviewTimeoutMargin is reserved from the API server timeout to respond in time
+	reviewTimeoutMargin = time.Second
+)
+
 var (
 	runtimeScheme = runtime.NewScheme()
 	codecs        = serializer.NewCodecFactory(runtimeScheme)
@@ -26,20 +38,24 @@ var (
 type WebhookServer struct {
 	admissionController AdmissionControllerInterface
 
-	server *http.Server
+	server        *http.Server
+	metricsServer *http.Server
 
 	logger *logrus.Logger
 
 	certificateReader CertificateReader
+
+	verificationTimeout time.Duration
 }
 
 // NewWebhookServer is a constructor for WebhookServer
-func NewWebhookServer(admissionController AdmissionControllerInterface, logger *logrus.Logger, certificateReader CertificateReader) *WebhookServer {
+func NewWebhookServer(admissionController AdmissionControllerInterface, logger *logrus.Logger, certificateReader CertificateReader, verificationTimeout time.Duration) *WebhookServer {
 
 	srv := &WebhookServer{
 		admissionController: admissionController,
 		logger:              logger,
 		certificateReader:   certificateReader,
+		verificationTimeout: verificationTimeout,
 	}
 
 	return srv
@@ -67,10 +83,7 @@ func (srv *WebhookServer) Start(port int) chan bool {
 		TLSConfig: tlsConfig,
 	}
 
-	router := mux.NewRouter()
-	router.HandleFunc("/ping", srv.handlePing)
-	router.HandleFunc("/mutate", srv.handleMutate).Methods("POST")
-	srv.server.Handler = router
+	srv.server.Handler = srv.router()
 
 	// Channel to indicate when the server stopped listening for some reason
 	doneListeningChannel := make(chan bool)
@@ -91,10 +104,47 @@ func (srv *WebhookServer) Start(port int) chan bool {
 	return doneListeningChannel
 }
 
+// StartMetrics starts the plain HTTP server publishing metrics on /debug/vars. Metrics are not
+// served on the webhook port, which the API server and any client reaching the service can access.
+func (srv *WebhookServer) StartMetrics(port int) {
+	serverLogger := srv.logger.WithField(portField, port)
+	serverLogger.Infof("starting metrics server...")
+
+	srv.metricsServer = &http.Server{
+		Addr:    fmt.Sprintf(":%v", port),
+		Handler: metricsRouter(),
+	}
+
+	go func() {
+		if err := srv.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			serverLogger.WithError(err).Errorf("Failed to listen and serve metrics server")
+		}
+	}()
+}
+
+// router routes webhook requests
+func (srv *WebhookServer) router() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/ping", srv.handlePing)
+	router.HandleFunc("/mutate", srv.handleMutate).Methods("POST")
+	router.HandleFunc("/validate", srv.handleValidate).Methods("POST")
+	return router
+}
+
+// metricsRouter routes metrics requests
+func metricsRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/debug/vars", expvar.Handler())
+	return router
+}
+
 // Stop stop webhook server
 func (srv *WebhookServer) Stop() {
 	srv.logger.Infof("shutting down webhook server gracefully...")
 	srv.server.Shutdown(context.Background())
+	if srv.metricsServer != nil {
+		srv.metricsServer.Shutdown(context.Background())
+	}
 
 }
 
@@ -109,13 +159,28 @@ func (srv *WebhookServer) handlePing(w http.ResponseWriter, r *http.Request) {
 }
 
 func (srv *WebhookServer) handleMutate(w http.ResponseWriter, r *http.Request) {
-	handleMutateInternal(srv, w, r)
+	handleAdmissionReviewInternal(srv, w, r, "handleMutate", srv.admissionController.Mutate)
+	return
+}
+
+func (srv *WebhookServer) handleValidate(w http.ResponseWriter, r *http.Request) {
+	handleAdmissionReviewInternal(srv, w, r, "handleValidate", srv.admissionController.Validate)
 	return
 }
 
-func handleMutateInternal(srv *WebhookServer, w http.ResponseWriter, r *http.Request) {
+// admissionReviewFunc reviews an admission request and returns the response
+type admissionReviewFunc func(ctx context.Context, ar *v1beta1.AdmissionReview) *admissionResponse
+
+// admissionReviewResponse is the admission review returned to the API server, with warnings in the response
+type admissionReviewResponse struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Response *admissionResponse `json:"response,omitempty"`
+}
+
+func handleAdmissionReviewInternal(srv *WebhookServer, w http.ResponseWriter, r *http.Request, handler string, review admissionReviewFunc) {
 	httpLogger := srv.httpLogger(r)
-	httpLogger.Infof("handleMutate invoked.")
+	httpLogger.Infof("%s invoked.", handler)
 
 	if r.Method != http.MethodPost {
 
@@ -149,26 +214,47 @@ func handleMutateInternal(srv *WebhookServer, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
+	var response *admissionResponse
 
+	// admission.k8s.io/v1 and v1beta1 share the wire format, and the vendored k8s.io/api
+	// has no admission/v1 types, so both are decoded into v1beta1 types and answered
+	// in the version of the request.
 	admissionReview := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &admissionReview); err != nil {
+		// a review that cannot be decoded has no request UID to answer, so the API server applies
+		// the failurePolicy of the webhook whatever the mode. Objects of decoded reviews that cannot
+		// be decoded are decided by the mode of their namespace.
 		httpLogger.Errorf("Unable to decode request body: %v", err)
 		http.Error(w, "Unable to decode request body", http.StatusBadRequest)
 		return
 	}
 
-	// Mutate using the provided controller
-	admissionResponse = srv.admissionController.Mutate(&admissionReview)
+	apiVersion := admissionReview.APIVersion
+	if admissionReview.Kind != admissionReviewKind || (apiVersion != admissionV1 && apiVersion != admissionV1beta1) {
+		httpLogger.Errorf("unsupported admission review, apiVersion=%q, kind=%q", apiVersion, admissionReview.Kind)
+		http.Error(w, fmt.Sprintf("unsupported admission review %s/%s", apiVersion, admissionReview.Kind), http.StatusBadRequest)
+		return
+	}
 
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if admissionReview.Request != nil {
-			admissionReview.Response.UID = admissionReview.Request.UID
-		}
+	if admissionReview.Request == nil {
+		httpLogger.Errorf("empty admission request, apiVersion=%q", apiVersion)
+		http.Error(w, "empty admission request", http.StatusBadRequest)
+		return
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	// Review using the provided controller
+	ctx, cancel := srv.reviewContext(r)
+	defer cancel()
+	response = review(ctx, &admissionReview)
+
+	if response != nil && response.AdmissionResponse != nil {
+		response.UID = admissionReview.Request.UID
+	}
+
+	resp, err := json.Marshal(admissionReviewResponse{
+		TypeMeta: admissionReview.TypeMeta,
+		Response: response,
+	})
 	if err != nil {
 		httpLogger.Errorf("Unable to encode response: %v", err)
 		http.Error(w, fmt.Sprintf("Unable to encode response: %v", err), http.StatusInternalServerError)
@@ -184,6 +270,28 @@ func handleMutateInternal(srv *WebhookServer, w http.ResponseWriter, r *http.Req
 	return
 }
 
+// reviewContext returns context of the admission review. Its deadline is bound by the
+// verification timeout, and by the timeout the API server waits for the webhook,
+// passed in the timeout query parameter, minus a margin to respond in time.
+func (srv *WebhookServer) reviewContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := srv.verificationTimeout
+	if apiTimeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && apiTimeout > 0 {
+		if apiTimeout > 2*reviewTimeoutMargin {
+			apiTimeout -= reviewTimeoutMargin
+		} else {
+			apiTimeout /= 2
+		}
+		if timeout <= 0 || apiTimeout < timeout {
+			timeout = apiTimeout
+		}
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
 func (srv *WebhookServer) httpLogger(r *http.Request) *logrus.Entry {
 	return srv.logger.
 		WithField(remoteAddrField, r.RemoteAddr).
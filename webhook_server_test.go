@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// fakeAdmissionController records reviewed requests and allows them
+type fakeAdmissionController struct {
+	reviewed []string
+}
+
+func (f *fakeAdmissionController) Mutate(ctx context.Context, ar *v1beta1.AdmissionReview) *admissionResponse {
+	f.reviewed = append(f.reviewed, "mutate")
+	pt := v1beta1.PatchTypeJSONPatch
+	return &admissionResponse{
+		AdmissionResponse: &v1beta1.AdmissionResponse{Allowed: true, Patch: []byte(`[]`), PatchType: &pt},
+		Warnings:          []string{"image verification failed"},
+	}
+}
+
+func (f *fakeAdmissionController) Validate(ctx context.Context, ar *v1beta1.AdmissionReview) *admissionResponse {
+	f.reviewed = append(f.reviewed, "validate")
+	return &admissionResponse{AdmissionResponse: &v1beta1.AdmissionResponse{Allowed: true}}
+}
+
+func Test_handleAdmissionReview(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	ac := &fakeAdmissionController{}
+	srv := NewWebhookServer(ac, logger, nil, time.Second)
+
+	body := []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"42","kind":{"version":"v1","kind":"Pod"},"object":{}}}`)
+
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+		patched bool
+	}{
+		{path: "/mutate", handler: srv.handleMutate, patched: true},
+		{path: "/validate", handler: srv.handleValidate, patched: false},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tc.path, bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var review v1beta1.AdmissionReview
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+			require.NotNil(t, review.Response)
+			assert.True(t, review.Response.Allowed)
+			assert.Equal(t, "42", string(review.Response.UID))
+			assert.Equal(t, tc.patched, review.Response.PatchType != nil)
+		})
+	}
+	assert.Equal(t, []string{"mutate", "validate"}, ac.reviewed)
+}
+
+func Test_handleAdmissionReviewVersions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	srv := NewWebhookServer(&fakeAdmissionController{}, logger, nil, time.Second)
+
+	testCases := []struct {
+		name         string
+		apiVersion   string
+		expectedCode int
+	}{
+		{name: "v1", apiVersion: admissionV1, expectedCode: http.StatusOK},
+		{name: "v1beta1", apiVersion: admissionV1beta1, expectedCode: http.StatusOK},
+		{name: "Unsupported", apiVersion: "admission.k8s.io/v2", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := []byte(`{"apiVersion":"` + tc.apiVersion + `","kind":"AdmissionReview","request":{"uid":"42","kind":{"version":"v1","kind":"Pod"},"object":{}}}`)
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			srv.handleMutate(w, r)
+			require.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+
+			var review map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+			assert.Equal(t, `"`+tc.apiVersion+`"`, string(review["apiVersion"]))
+			assert.Equal(t, `"AdmissionReview"`, string(review["kind"]))
+			assert.NotContains(t, review, "request")
+
+			var response admissionResponse
+			require.NoError(t, json.Unmarshal(review["response"], &response))
+			assert.Equal(t, "42", string(response.UID))
+			require.NotNil(t, response.PatchType)
+			assert.Equal(t, v1beta1.PatchTypeJSONPatch, *response.PatchType)
+			assert.Equal(t, []string{"image verification failed"}, response.Warnings)
+		})
+	}
+}
+
+func Test_handleAdmissionReviewV1RoundTrip(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	policy := DefaultPolicy()
+	policy.Mode = modeWarn
+	aci, err := NewAdmissionController("test_region", "test_bucket", policy, nil, nil, nil, CacheConfig{}, RegistryConfig{}, logger)
+	require.NoError(t, err)
+	ac := aci.(*admissionController)
+	fake := &fakeImageController{manifests: map[string]string{}}
+	ac.imageManager, ac.signatureStore = fake, fake
+	srv := NewWebhookServer(ac, logger, nil, time.Second)
+
+	// the image has no manifest, so warn mode allows it with a warning and annotates the pod
+	body := []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"42","kind":{"version":"v1","kind":"Pod"},` +
+		`"operation":"CREATE","dryRun":false,"object":{"metadata":{"name":"app"},"spec":{"containers":[{"name":"app","image":"registry/app:v1"}]}}}}`)
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	srv.handleMutate(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var review struct {
+		APIVersion string             `json:"apiVersion"`
+		Kind       string             `json:"kind"`
+		Response   *admissionResponse `json:"response"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+	assert.Equal(t, admissionV1, review.APIVersion)
+	assert.Equal(t, admissionReviewKind, review.Kind)
+	require.NotNil(t, review.Response)
+	assert.True(t, review.Response.Allowed)
+	assert.Equal(t, "42", string(review.Response.UID))
+	require.NotNil(t, review.Response.PatchType)
+	assert.Equal(t, v1beta1.PatchTypeJSONPatch, *review.Response.PatchType)
+	assert.Contains(t, string(review.Response.Patch), verificationAnnotation)
+	require.Len(t, review.Response.Warnings, 1)
+	assert.Contains(t, review.Response.Warnings[0], "image verification failed")
+}
+
+func Test_reviewContext(t *testing.T) {
+	srv := NewWebhookServer(&fakeAdmissionController{}, logrus.New(), nil, 25*time.Second)
+
+	testCases := []struct {
+		url      string
+		expected time.Duration
+	}{
+		{url: "/validate", expected: 25 * time.Second},
+		{url: "/validate?timeout=10s", expected: 9 * time.Second},
+		{url: "/validate?timeout=30s", expected: 25 * time.Second},
+		{url: "/validate?timeout=1s", expected: 500 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			ctx, cancel := srv.reviewContext(httptest.NewRequest(http.MethodPost, tc.url, nil))
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			assert.InDelta(t, tc.expected.Seconds(), time.Until(deadline).Seconds(), 0.1)
+		})
+	}
+}
+
+func Test_metricsRouter(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	srv := NewWebhookServer(&fakeAdmissionController{}, logger, nil, time.Second)
+
+	// metrics are only served by the metrics server
+	w := httptest.NewRecorder()
+	srv.router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	metricsRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"admission"`)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podSpecPaths maps supported workload kinds to the location of their pod spec
+// within the object. The same path, joined with "/", is used as the prefix of
+// JSON patch operations against the pod spec.
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+	// EphemeralContainers is sent for updates of the pods/ephemeralcontainers subresource
+	"EphemeralContainers": {},
+}
+
+const (
+	containersList          = "containers"
+	initContainersList      = "initContainers"
+	ephemeralContainersList = "ephemeralContainers"
+
+	// ephemeralContainersSubresource is the subresource of pods updated to add ephemeral containers
+	ephemeralContainersSubresource = "ephemeralcontainers"
+)
+
+// podSpec extends the vendored pod spec with ephemeral containers. Ephemeral
+// containers are decoded as regular containers since only their name and image
+// are inspected.
+type podSpec struct {
+	corev1.PodSpec
+	EphemeralContainers []corev1.Container `json:"ephemeralContainers,omitempty"`
+}
+
+// containerList is a named list of containers in a pod spec
+type containerList struct {
+	name       string
+	containers []corev1.Container
+}
+
+// containerLists returns every container list of the pod spec
+func (p *podSpec) containerLists() []containerList {
+	return []containerList{
+		{name: initContainersList, containers: p.InitContainers},
+		{name: containersList, containers: p.Containers},
+		{name: ephemeralContainersList, containers: p.EphemeralContainers},
+	}
+}
+
+// subresourceContainerLists returns the container lists of the pod spec that the subresource updates,
+// every container list if the request is not for a subresource
+func (p *podSpec) subresourceContainerLists(subresource string) []containerList {
+	lists := p.containerLists()
+	if subresource != ephemeralContainersSubresource {
+		return lists
+	}
+	// other containers of the pod were verified when it was created and cannot be updated
+	for _, list := range lists {
+		if list.name == ephemeralContainersList {
+			return []containerList{list}
+		}
+	}
+	return nil
+}
+
+// errUnsupportedKind is returned for kinds that have no known pod spec location
+var errUnsupportedKind = errors.New("unsupported kind")
+
+// extractPodSpec locates the pod spec of a workload of the given kind and returns
+// it along with the JSON patch path pointing at it
+func extractPodSpec(kind string, raw []byte) (*podSpec, string, error) {
+	path, ok := podSpecPaths[kind]
+	if !ok {
+		return nil, "", errors.Annotatef(errUnsupportedKind, "kind=%q", kind)
+	}
+
+	node := json.RawMessage(raw)
+	for _, field := range path {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(node, &fields); err != nil {
+			return nil, "", errors.Annotatef(err, "kind=%q, field=%q", kind, field)
+		}
+		if node, ok = fields[field]; !ok {
+			return nil, "", errors.Errorf("api=extractPodSpec, reason='missing field', kind=%q, field=%q", kind, field)
+		}
+	}
+
+	spec := new(podSpec)
+	if err := json.Unmarshal(node, spec); err != nil {
+		return nil, "", errors.Annotatef(err, "kind=%q", kind)
+	}
+
+	specPath := ""
+	if len(path) > 0 {
+		specPath = "/" + strings.Join(path, "/")
+	}
+	return spec, specPath, nil
+}
+
+// annotationsPatch returns JSON patch operations setting the annotations of the object
+func annotationsPatch(raw []byte, annotations map[string]string) ([]patchOperation, error) {
+	var object struct {
+		Metadata *struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, errors.Annotate(err, "api=annotationsPatch")
+	}
+
+	switch {
+	case object.Metadata == nil:
+		return []patchOperation{{Op: "add", Path: "/metadata", Value: map[string]interface{}{"annotations": annotations}}}, nil
+	case object.Metadata.Annotations == nil:
+		return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}}, nil
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	patch := make([]patchOperation, 0, len(keys))
+	for _, key := range keys {
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapePatchPath(key), Value: annotations[key]})
+	}
+	return patch, nil
+}
+
+// escapePatchPath escapes the JSON pointer reference token, ~ as ~0 and / as ~1
+func escapePatchPath(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuiteExtractPodSpec(t *testing.T) {
+
+	testCases := []struct {
+		name          string
+		kind          string
+		raw           string
+		expectedImage string
+		expectedPath  string
+		expectedError string
+	}{
+		{
+			name:          "Pod",
+			kind:          "Pod",
+			raw:           `{"spec":{"containers":[{"name":"c","image":"pod:v1"}]}}`,
+			expectedImage: "pod:v1",
+			expectedPath:  "/spec",
+		},
+		{
+			name:          "Deployment",
+			kind:          "Deployment",
+			raw:           `{"spec":{"template":{"spec":{"containers":[{"name":"c","image":"deployment:v1"}]}}}}`,
+			expectedImage: "deployment:v1",
+			expectedPath:  "/spec/template/spec",
+		},
+		{
+			name:          "Job",
+			kind:          "Job",
+			raw:           `{"spec":{"template":{"spec":{"containers":[{"name":"c","image":"job:v1"}]}}}}`,
+			expectedImage: "job:v1",
+			expectedPath:  "/spec/template/spec",
+		},
+		{
+			name:          "CronJob",
+			kind:          "CronJob",
+			raw:           `{"spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"c","image":"cronjob:v1"}]}}}}}}`,
+			expectedImage: "cronjob:v1",
+			expectedPath:  "/spec/jobTemplate/spec/template/spec",
+		},
+		{
+			name:          "EphemeralContainers",
+			kind:          "EphemeralContainers",
+			raw:           `{"ephemeralContainers":[{"name":"debugger","image":"busybox:v1"}]}`,
+			expectedImage: "busybox:v1",
+			expectedPath:  "",
+		},
+		{
+			name:          "MissingTemplate",
+			kind:          "StatefulSet",
+			raw:           `{"spec":{}}`,
+			expectedError: `api=extractPodSpec, reason='missing field', kind="StatefulSet", field="template"`,
+		},
+		{
+			name:          "UnknownKind",
+			kind:          "Service",
+			raw:           `{"spec":{}}`,
+			expectedError: `kind="Service": unsupported kind`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			podSpec, path, err := extractPodSpec(tc.kind, []byte(tc.raw))
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			var images []string
+			for _, list := range podSpec.containerLists() {
+				for _, container := range list.containers {
+					images = append(images, container.Image)
+				}
+			}
+			assert.Equal(t, []string{tc.expectedImage}, images)
+			assert.Equal(t, tc.expectedPath, path)
+		})
+	}
+
+	_, _, err := extractPodSpec("Service", []byte(`{}`))
+	assert.Equal(t, errUnsupportedKind, errors.Cause(err))
+}
+
+func Test_containerLists(t *testing.T) {
+	raw := `{"spec":{
+		"initContainers":[{"name":"init","image":"init:v1"}],
+		"containers":[{"name":"app","image":"app:v1"},{"name":"sidecar","image":"sidecar:v1"}],
+		"ephemeralContainers":[{"name":"debugger","image":"busybox:v1","targetContainerName":"app"}]
+	}}`
+	podSpec, _, err := extractPodSpec("Pod", []byte(raw))
+	require.NoError(t, err)
+
+	lists := podSpec.containerLists()
+	require.Len(t, lists, 3)
+	assert.Equal(t, initContainersList, lists[0].name)
+	assert.Equal(t, "init:v1", lists[0].containers[0].Image)
+	assert.Equal(t, containersList, lists[1].name)
+	assert.Len(t, lists[1].containers, 2)
+	assert.Equal(t, ephemeralContainersList, lists[2].name)
+	assert.Equal(t, "busybox:v1", lists[2].containers[0].Image)
+}
+
+func Test_annotationsPatch(t *testing.T) {
+	annotations := map[string]string{"stampy.io/unverified-images": "registry/app:v1"}
+	testCases := []struct {
+		name     string
+		raw      string
+		expected []patchOperation
+	}{
+		{
+			name:     "NoMetadata",
+			raw:      `{"spec":{}}`,
+			expected: []patchOperation{{Op: "add", Path: "/metadata", Value: map[string]interface{}{"annotations": annotations}}},
+		},
+		{
+			name:     "NoAnnotations",
+			raw:      `{"metadata":{"name":"app"}}`,
+			expected: []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}},
+		},
+		{
+			name:     "Annotations",
+			raw:      `{"metadata":{"annotations":{"team":"platform"}}}`,
+			expected: []patchOperation{{Op: "add", Path: "/metadata/annotations/stampy.io~1unverified-images", Value: "registry/app:v1"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patch, err := annotationsPatch([]byte(tc.raw), annotations)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, patch)
+		})
+	}
+}